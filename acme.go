@@ -3,10 +3,18 @@ package acme
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/google/uuid"
+	"github.com/mholt/acmez/acme"
 )
 
 const (
@@ -15,53 +23,284 @@ const (
 	CHALLENGE         = "challenge"
 	DOMAIN            = "domain"
 	PORT              = "port"
+	RENEWBEFORE       = "renew_before"
+	RENEWJITTER       = "renew_jitter"
+	RENEWWINDOW       = "renew_window"
+	RATELIMIT         = "ratelimit"
+	ONDEMAND          = "on_demand"
+	IP                = "ip"
+	ISSUER            = "issuer"
+	WAITFORCERT       = "wait_for_cert"
+	STORAGE           = "storage"
+	TENANT            = "tenant"
+	EMAIL             = "email"
+	EAB               = "eab"
+	CA                = "ca"
+	REQUIREAPPROVAL   = "require_approval"
+	POLICY            = "policy"
+	FALLTHROUGH       = "fallthrough"
+	CAA               = "caa"
+	SOA               = "soa"
+	ADDRESS           = "address"
+	TTL               = "ttl"
+	NAMESERVER        = "nameserver"
+	DNSSEC            = "dnssec"
+	TRANSFER          = "transfer"
+	ACMEIssuer        = "acme"
+	InternalIssuer    = "internal"
 )
 
+// storagePrefix namespaces everything the plugin itself keeps in
+// certmagic storage, next to certmagic's own certificates and accounts.
+const storagePrefix = "coredns-acme"
+
 type ACME struct {
 	Manager *certmagic.ACMEManager
 	Config  *certmagic.Config
-	Zone    string
+	// OnDemandConfig shares Config's cache and issuers but obtains
+	// certificates during TLS handshakes. It is nil unless on_demand is set.
+	OnDemandConfig *certmagic.Config
+	Cache          *certmagic.Cache
+	Ledger         *Ledger
+	Lock           *IssuanceLock
+	Inventory      *Inventory
+	// Policy restricts the names certificates are requested for. It is nil
+	// unless policy is set.
+	Policy *NamePolicy
+	// InternalCA issues the certificates instead of the ACME CA when the
+	// internal issuer is configured.
+	InternalCA *InternalCA
+	Zone       string
+	IPs        []string
+	Tenant     string
+	Renewal    RenewalPolicy
 }
 
-func NewACME(acmeManagerTemplate certmagic.ACMEManager, zone string) ACME {
+func NewACME(opts acmeOptions) ACME {
+	acmeManagerTemplate, zone, renewal := opts.template, opts.zone, opts.renewal
 	configTemplate := certmagic.NewDefault()
+	configTemplate.RenewalWindowRatio = renewal.Ratio
+	configTemplate.DefaultServerName = zone
+	configTemplate.Storage = newStorage(opts)
+	var config *certmagic.Config
 	cache := certmagic.NewCache(certmagic.CacheOptions{
 		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
-			return configTemplate, nil
+			// certmagic's maintenance loop asks for the config of every cached
+			// certificate before checking whether it needs renewal, so the
+			// renewal policy is applied per certificate here.
+			certConfig := *config
+			certConfig.RenewalWindowRatio = renewal.windowRatio(cert.Leaf.NotBefore, cert.Leaf.NotAfter, time.Now())
+			// short-lived certificates carry no OCSP responder, and are not
+			// worth stapling even when they do
+			certConfig.OCSP.DisableStapling = isShortLived(cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+			return &certConfig, nil
 		},
 	})
-	config := certmagic.New(cache, *configTemplate)
+	inventory := &Inventory{Storage: configTemplate.Storage, Renewal: renewal}
+	configTemplate.OnEvent = func(event string, data interface{}) {
+		if event != "cached_managed_cert" {
+			return
+		}
+		// certificates loaded from storage were not issued by this process
+		for _, name := range data.([]string) {
+			for _, cert := range cache.AllMatchingCertificates(name) {
+				if err := inventory.recordCertificate(name, cert.Leaf); err != nil {
+					log.Warningf("recording %s in the inventory: %v", name, err)
+				}
+			}
+		}
+	}
+	config = certmagic.New(cache, *configTemplate)
+	ledger := &Ledger{Storage: config.Storage, Limits: opts.rateLimits}
+	lock := &IssuanceLock{Storage: config.Storage, Name: zone, Owner: uuid.New().String()}
+	acmeManagerTemplate.NewAccountFunc = func(ctx context.Context, _ *certmagic.ACMEManager, account acme.Account) (acme.Account, error) {
+		return account, ledger.Reserve(ctx, AccountEvent, zone)
+	}
+	if acmeManagerTemplate.DNS01Solver != nil {
+		acmeManagerTemplate.DNS01Solver = inventorySolver{Solver: acmeManagerTemplate.DNS01Solver, inventory: inventory}
+	}
 	acmeManager := certmagic.NewACMEManager(config, acmeManagerTemplate)
-	config.Issuers = append(config.Issuers, acmeManager)
+	config.Issuers = []certmagic.Issuer{acmeIssuer{ACMEManager: acmeManager, ledger: ledger, lock: lock, provider: opts.provider, approvals: opts.approvals}}
+	var internalCA *InternalCA
+	if opts.issuer == InternalIssuer {
+		internalCA = &InternalCA{
+			Storage:             config.Storage,
+			LeafLifetime:        opts.leafLifetime,
+			PermittedDNSDomains: []string{strings.TrimSuffix(strings.ToLower(zone), ".")},
+		}
+		for _, ip := range opts.ips {
+			internalCA.PermittedIPRanges = append(internalCA.PermittedIPRanges, hostNetwork(net.ParseIP(ip)))
+		}
+		config.Issuers = []certmagic.Issuer{internalCA}
+	}
+	for i, issuer := range config.Issuers {
+		config.Issuers[i] = inventoryIssuer{Issuer: issuer, inventory: inventory}
+	}
+	var onDemandConfig *certmagic.Config
+	if opts.onDemand != nil {
+		opts.onDemand.Inventory = inventory
+		onDemandTemplate := *config
+		onDemandTemplate.OnDemand = &certmagic.OnDemandConfig{DecisionFunc: func(name string) error {
+			if err := opts.policy.Check([]string{name}); err != nil {
+				return err
+			}
+			return opts.onDemand.Decide(name)
+		}}
+		onDemandConfig = certmagic.New(cache, onDemandTemplate)
+	}
 	return ACME{
-		Config:  config,
-		Manager: acmeManager,
-		Zone:    zone,
+		Config:         config,
+		OnDemandConfig: onDemandConfig,
+		Manager:        acmeManager,
+		Cache:          cache,
+		Ledger:         ledger,
+		Lock:           lock,
+		Inventory:      inventory,
+		Policy:         opts.policy,
+		InternalCA:     internalCA,
+		Zone:           zone,
+		IPs:            opts.ips,
+		Tenant:         opts.tenant,
+		Renewal:        renewal,
 	}
 }
 
+// newStorage returns the storage configured by the storage and tenant
+// directives, certmagic's default storage otherwise.
+func newStorage(opts acmeOptions) certmagic.Storage {
+	storage := certmagic.Default.Storage
+	if opts.storagePath != "" {
+		storage = &certmagic.FileStorage{Path: opts.storagePath}
+	}
+	if opts.tenant != "" {
+		storage = newTenantStorage(storage, opts.tenant)
+	}
+	return storage
+}
+
+// acmeIssuer wraps certmagic's ACMEManager with the plugin's own checks.
+type acmeIssuer struct {
+	*certmagic.ACMEManager
+	ledger *Ledger
+	lock   *IssuanceLock
+	// provider holds the DNS-01 challenge records to remove after a failed
+	// order
+	provider *Provider
+	// approvals holds new orders until they are approved, when
+	// require_approval is set
+	approvals *ApprovalQueue
+}
+
+func (i acmeIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	name := csrName(csr)
+	if i.approvals != nil {
+		if err := i.approvals.Check(csr); err != nil {
+			return nil, err
+		}
+	}
+	if err := i.lock.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer i.lock.Release()
+	cert, err := i.obtain(ctx, csr)
+	if err != nil {
+		i.logCleanUp(csr, err)
+	} else if err := i.lock.Check(); err != nil {
+		// another replica took the lease over while the order was
+		// placed, its certificate is the one to store
+		return nil, err
+	}
+	if err != nil && isValidationFailure(err) {
+		if recordErr := i.ledger.Record(ctx, FailedValidationEvent, name); recordErr != nil {
+			return nil, fmt.Errorf("%v (recording failed validation: %v)", err, recordErr)
+		}
+	}
+	return cert, err
+}
+
+// obtain orders the certificate for csr. DNS names are ordered through the
+// journal when there is one, so that an order in flight when the process
+// stopped is resumed; IP identifiers, which DNS-01 cannot validate, are
+// left to certmagic.
+func (i acmeIssuer) obtain(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	if i.provider != nil && i.provider.journal != nil && len(csr.IPAddresses) == 0 {
+		return i.issueJournaled(ctx, csr)
+	}
+	if err := i.ledger.ReserveOrder(ctx, csrNames(csr)); err != nil {
+		return nil, err
+	}
+	return i.ACMEManager.Issue(ctx, csr)
+}
+
+// PreCheck leaves IP identifiers out of certmagic's check, which still
+// considers them ineligible for public CAs (RFC 8738 made them eligible).
+func (i acmeIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	dnsNames, _ := splitIdentifiers(names)
+	return i.ACMEManager.PreCheck(ctx, dnsNames, interactive)
+}
+
+// OnStartup serves the HTTP and TLS-ALPN challenges on their configured
+// ports for as long as the process runs. certmagic only does this itself
+// while a challenge is pending, and its TLS-ALPN server cannot answer for
+// IP identifiers.
 func (a ACME) OnStartup() error {
 	httpPort := fmt.Sprintf(":%d", a.Manager.AltHTTPPort)
 	tlsalpnPort := fmt.Sprintf(":%d", a.Manager.AltTLSALPNPort)
 	tlsConfig := a.Config.TLSConfig()
-	var err error
+	tlsConfig.GetCertificate = a.getCertificate
 	if !a.Manager.DisableTLSALPNChallenge {
-		go func() {
-			_, err = tls.Listen("tcp", tlsalpnPort, tlsConfig)
-		}()
+		ln, err := tls.Listen("tcp", tlsalpnPort, tlsConfig)
+		if err != nil {
+			return err
+		}
+		go serveHandshakes(ln)
 	}
 	if !a.Manager.DisableHTTPChallenge {
-		go func() { err = http.ListenAndServe(httpPort, a.Manager.HTTPChallengeHandler(http.NewServeMux())) }()
+		ln, err := net.Listen("tcp", httpPort)
+		if err != nil {
+			return err
+		}
+		go http.Serve(ln, a.Manager.HTTPChallengeHandler(http.NewServeMux()))
 	}
-	return err
+	return nil
 }
 
+// serveHandshakes completes the TLS handshake of every connection on ln,
+// which is all a TLS-ALPN challenge needs.
+func serveHandshakes(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.(*tls.Conn).Handshake()
+		}()
+	}
+}
+
+// IssueCert manages the certificates for zones. Only the replica holding
+// the issuance lease orders certificates, the others wait for it and then
+// load the certificates it stored.
 func (a ACME) IssueCert(zones []string) error {
-	err := a.Config.ManageSync(zones)
-	return err
+	if err := a.Policy.Check(zones); err != nil {
+		return err
+	}
+	if err := a.Lock.Acquire(context.Background()); err != nil {
+		return err
+	}
+	defer a.Lock.Release()
+	if err := a.Config.ManageSync(zones); err != nil {
+		return err
+	}
+	return a.Lock.Check()
 }
 
 func (a ACME) GetCert(zone string) error {
+	if err := a.Policy.Check([]string{zone}); err != nil {
+		return err
+	}
 	err := a.Config.ObtainCert(context.Background(), zone, false)
 	return err
 }
@@ -70,3 +309,53 @@ func (a ACME) RevokeCert(zone string) error {
 	err := a.Config.RevokeCert(context.Background(), zone, 0, false)
 	return err
 }
+
+// Account returns the ACME account registered with the CA.
+func (a ACME) Account(ctx context.Context) (acme.Account, error) {
+	return acmeIssuer{ACMEManager: a.Manager, ledger: a.Ledger}.account(ctx)
+}
+
+// WatchRestored removes the challenges journal restored once the CA is done
+// with them, asking it every restoredCheckInterval until none is pending.
+func (a ACME) WatchRestored(journal *OrderJournal, p *Provider) {
+	client := &acme.Client{Directory: a.Manager.CA}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), authzCleanupTimeout)
+		account, err := a.Account(ctx)
+		pending := 0
+		if err == nil {
+			pending, err = journal.CheckRestored(ctx, client, account, p)
+		}
+		cancel()
+		if err != nil {
+			log.Warningf("Checking restored challenges for %s: %v", journal.Zone, err)
+		} else if pending == 0 {
+			return
+		}
+		time.Sleep(restoredCheckInterval)
+	}
+}
+
+// ExportRoot writes the internal CA's root certificate to path, for clients
+// to add to their trust stores.
+func (a ACME) ExportRoot(path string) error {
+	if a.InternalCA == nil {
+		return fmt.Errorf("no internal CA configured")
+	}
+	root, err := a.InternalCA.RootPEM(context.Background())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, root, 0644)
+}
+
+// NextRenewal returns the time at which the cached certificate for zone is
+// scheduled to be renewed.
+func (a ACME) NextRenewal(zone string) (time.Time, error) {
+	certs := a.Cache.AllMatchingCertificates(zone)
+	if len(certs) == 0 {
+		return time.Time{}, fmt.Errorf("no certificate cached for %s", zone)
+	}
+	leaf := certs[0].Leaf
+	return a.Renewal.NextRenewal(leaf.NotBefore, leaf.NotAfter, time.Now()), nil
+}
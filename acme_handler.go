@@ -3,9 +3,12 @@ package acme
 import (
 	"context"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
@@ -15,128 +18,417 @@ type AcmeHandler struct {
 	Next     plugin.Handler
 	provider *Provider
 	*AcmeConfig
+	// Fall passes queries for names that do not exist on to the next plugin.
+	Fall fall.F
+	// certReady is closed once the certificate is configured. It is only
+	// set when wait_for_cert is.
+	certReady chan struct{}
 }
 
 type AcmeConfig struct {
 	Zone                    string
-	Ipv4Addr                net.IP
-	Ipv6Addr                net.IP
+	Ipv4Addrs               []net.IP
+	Ipv6Addrs               []net.IP
 	AuthoritativeNameserver string
+	CAA                     *CAAPolicy
+	SOA                     SOAConfig
+	TTL                     TTLConfig
+	// Nameservers is the NS set of the zone, with the addresses of those
+	// inside the zone served as glue.
+	Nameservers []Nameserver
+	// Signer signs the answers when dnssec is set.
+	Signer *ZoneSigner
+	// Transfer allows secondaries to transfer the zone when set.
+	Transfer *TransferConfig
+}
+
+// TTLConfig holds the TTLs set by the ttl directive, in seconds. Zero TTLs
+// default to the values below.
+type TTLConfig struct {
+	// Apex is the TTL of the records of the zone apex.
+	Apex uint32
+	// Challenge is the TTL of the records of challenge names, kept short so
+	// that resolvers do not hold on to the TXT records of a previous order.
+	Challenge uint32
+	// Negative is the TTL of the SOA in negative answers, which resolvers
+	// cache them for (RFC 2308). It is capped at the SOA minimum.
+	Negative uint32
 }
 
 const (
-	dnsChallengeString   = "_acme-challenge."
-	certificateAuthority = "letsencrypt.org"
+	defaultApexTTL      = 3600
+	defaultChallengeTTL = 30
+	defaultNegativeTTL  = 60
 )
 
+// Nameserver is a nameserver of the zone and, if it is inside the zone, its
+// addresses.
+type Nameserver struct {
+	Name      string
+	Addresses []net.IP
+}
+
+// SOAConfig holds the SOA fields set by the soa directive. Empty names
+// default to the authoritative nameserver and hostmaster at the zone, and
+// zero times to the defaults below.
+type SOAConfig struct {
+	Mname   string
+	Rname   string
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// Default SOA times, in seconds. The minimum also bounds negative caching
+// (RFC 2308), so it is kept short for challenge names looked up before
+// their TXT records are presented.
+const (
+	defaultSOARefresh = 3600
+	defaultSOARetry   = 600
+	defaultSOAExpire  = 604800
+	defaultSOAMinimum = 60
+)
+
+const dnsChallengeString = "_acme-challenge."
+
 func (h AcmeHandler) Name() string { return pluginName }
 
+// Ready implements the ready plugin's Readiness interface, reporting not
+// ready while wait_for_cert is waiting for the certificate.
+func (h AcmeHandler) Ready() bool {
+	if h.certReady == nil {
+		return true
+	}
+	select {
+	case <-h.certReady:
+		return true
+	default:
+		return false
+	}
+}
+
 func (h AcmeHandler) getQualifiedZone(zone string) string {
 	if !strings.HasSuffix(zone, ".") {
 		return zone + "."
 	}
 	return zone
 }
+
+// ServeDNS answers authoritatively for the zone and its challenge names:
+// with NODATA and the SOA for types it has no records of, and NXDOMAIN for
+// names that do not exist, unless fallthrough is set for them. Queries for
+// other zones are passed on to the next plugin. With dnssec, answers to
+// queries with the DO bit set are signed and negative ones carry NSEC3
+// proofs.
 func (h AcmeHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	name, class := strings.ToLower(state.Name()), state.QClass()
+	zone := strings.ToLower(h.getQualifiedZone(h.Zone))
+	apex := h.apex(name)
+	if apex == "" {
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+	if qtype := state.QType(); qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		return h.transfer(ctx, state, zone)
+	}
 	a := new(dns.Msg)
 	a.SetReply(state.Req)
-	a.Answer = []dns.RR{}
-	class := state.QClass()
-	for _, question := range r.Question {
-		zone := strings.ToLower(question.Name)
-		if checkDNSChallenge(zone) {
-			switch question.Qtype {
-			case dns.TypeSOA:
-				h.handleSOA(ctx, zone, class, a)
-			case dns.TypeTXT:
-				err := h.solveDNSChallenge(ctx, zone, class, a)
-				if err != nil {
-					log.Errorf("acmeHandler.solveDNSChallenge for zone %s err: %+v", zone, err)
-					return 0, err
-				}
-			case dns.TypeNS:
-				rr := new(dns.NS)
-				rr.Ns = h.AuthoritativeNameserver
-				rr.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: class}
-				a.Answer = append(a.Answer, rr)
-			case dns.TypeA:
-				h.handleA(ctx, zone, class, a)
-			case dns.TypeAAAA:
-				h.handleAAAA(ctx, zone, class, a)
+	a.Authoritative = true
+	exists := h.exists(name, apex, zone)
+	if err := h.answer(ctx, name, apex, zone, state.QType(), class, a); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if !exists {
+		if h.Fall.Through(name) {
+			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+		}
+		a.Rcode = dns.RcodeNameError
+	}
+	ttl := orDefault(h.TTL.Apex, defaultApexTTL)
+	if checkDNSChallenge(name, zone) {
+		ttl = orDefault(h.TTL.Challenge, defaultChallengeTTL)
+	}
+	for _, rr := range append(a.Answer, a.Extra...) {
+		rr.Header().Ttl = ttl
+	}
+	signed := h.Signer != nil && state.Do()
+	if len(a.Answer) == 0 {
+		soa := new(dns.Msg)
+		h.handleSOA(ctx, apex, class, soa)
+		negative := orDefault(h.TTL.Negative, defaultNegativeTTL)
+		if minimum := soa.Answer[0].(*dns.SOA).Minttl; minimum < negative {
+			negative = minimum
+		}
+		soa.Answer[0].Header().Ttl = negative
+		a.Ns = soa.Answer
+		if signed {
+			a.Ns = append(a.Ns, h.denial(ctx, name, zone, class, exists, negative)...)
+		}
+	}
+	if signed {
+		if err := h.Signer.signMsg(a, time.Now()); err != nil {
+			log.Errorf("acmeHandler.ServeDNS signing the answer for %s err: %+v", name, err)
+			return dns.RcodeServerFailure, err
+		}
+		state.SizeAndDo(a)
+	}
+	err := w.WriteMsg(a)
+	if err != nil {
+		log.Error("acmeHandler.ServeDNS w.WriteMsg error: ", err)
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// answer adds the records of type qtype at name to a.
+func (h AcmeHandler) answer(ctx context.Context, name, apex, zone string, qtype, class uint16, a *dns.Msg) error {
+	if checkDNSChallenge(name, zone) {
+		switch qtype {
+		case dns.TypeSOA:
+			if name == apex {
+				h.handleSOA(ctx, name, class, a)
 			}
+		case dns.TypeTXT:
+			err := h.solveDNSChallenge(ctx, name, class, a)
+			if err != nil {
+				log.Errorf("acmeHandler.solveDNSChallenge for zone %s err: %+v", name, err)
+				return err
+			}
+		case dns.TypeNS:
+			if name == apex {
+				h.handleNS(ctx, name, zone, class, a)
+			}
+		case dns.TypeA:
+			h.handleA(ctx, name, class, a)
+		case dns.TypeAAAA:
+			h.handleAAAA(ctx, name, class, a)
+		}
+	} else if name == apex {
+		switch qtype {
+		case dns.TypeSOA:
+			h.handleSOA(ctx, name, class, a)
+		case dns.TypeNS:
+			h.handleNS(ctx, name, zone, class, a)
+		case dns.TypeCAA:
+			a.Answer = append(a.Answer, h.CAA.records(name, class)...)
+		case dns.TypeA:
+			h.handleA(ctx, name, class, a)
+		case dns.TypeAAAA:
+			h.handleAAAA(ctx, name, class, a)
+		case dns.TypeDNSKEY:
+			a.Answer = append(a.Answer, h.Signer.dnskeys(class)...)
+		case dns.TypeNSEC3PARAM:
+			a.Answer = append(a.Answer, h.Signer.nsec3param(class)...)
 		}
-		if zone == h.getQualifiedZone(h.Zone) {
-			switch question.Qtype {
-			case dns.TypeSOA:
-				h.handleSOA(ctx, zone, class, a)
-			case dns.TypeCAA:
-				rr := new(dns.CAA)
-				rr.Tag = "issue"
-				rr.Value = certificateAuthority
-				rr.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeCAA, Class: class}
-				a.Answer = append(a.Answer, rr)
-			case dns.TypeA:
-				h.handleA(ctx, zone, class, a)
-			case dns.TypeAAAA:
-				h.handleAAAA(ctx, zone, class, a)
+	} else if ns, ok := h.nameserver(name, zone); ok {
+		switch qtype {
+		case dns.TypeA, dns.TypeAAAA:
+			for _, rr := range addressRecords(name, class, ns.Addresses) {
+				if rr.Header().Rrtype == qtype {
+					a.Answer = append(a.Answer, rr)
+				}
 			}
 		}
 	}
-	if len(a.Answer) != 0 {
-		err := w.WriteMsg(a)
-		if err != nil {
-			log.Error("acmeHandler.ServeDNS w.WriteMsg error: ", err)
-			return 0, err
+	return nil
+}
+
+// exists reports whether name exists in the zone: whether it holds records
+// or is an empty non-terminal above names that do.
+func (h AcmeHandler) exists(name, apex, zone string) bool {
+	if name == apex || h.provider.hasNamesUnder(name) {
+		return true
+	}
+	for _, ns := range h.Nameservers {
+		nsName := strings.ToLower(ns.Name)
+		if dns.IsSubDomain(zone, nsName) && dns.IsSubDomain(name, nsName) {
+			return true
 		}
 	}
+	return false
+}
 
-	return h.Next.ServeDNS(ctx, w, r)
+// nsec3Types are the types answer can return, in the order of the NSEC3
+// type bit map.
+var nsec3Types = []uint16{
+	dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeTXT, dns.TypeAAAA,
+	dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeCAA,
 }
 
-func checkDNSChallenge(zone string) bool {
-	return strings.HasPrefix(zone, dnsChallengeString)
+// types returns the types of the records at name, for its NSEC3 type bit
+// map.
+func (h AcmeHandler) types(ctx context.Context, name, zone string, class uint16) []uint16 {
+	var types []uint16
+	for _, qtype := range nsec3Types {
+		a := new(dns.Msg)
+		if err := h.answer(ctx, name, h.apex(name), zone, qtype, class, a); err == nil && len(a.Answer) > 0 {
+			types = append(types, qtype)
+		}
+	}
+	if len(types) > 0 {
+		types = append(types, dns.TypeRRSIG)
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	}
+	return types
 }
 
-func (h *AcmeHandler) solveDNSChallenge(ctx context.Context, zone string, class uint16, a *dns.Msg) error {
-	a.Authoritative = true
-	records, err := h.provider.GetRecords(ctx, zone)
-	if err != nil {
-		return err
+// denial returns the NSEC3 records proving that name has no records of the
+// type asked for or, when it does not exist, the closest encloser proof and
+// the absence of a wildcard at the closest encloser (RFC 5155 section 7.2).
+func (h AcmeHandler) denial(ctx context.Context, name, zone string, class uint16, exists bool, ttl uint32) []dns.RR {
+	if exists {
+		return []dns.RR{h.Signer.match(name, h.types(ctx, name, zone, class), class, ttl)}
+	}
+	encloser, next := name, name
+	for encloser != zone && !h.exists(encloser, h.apex(encloser), zone) {
+		next = encloser
+		i, _ := dns.NextLabel(encloser, 0)
+		encloser = encloser[i:]
+	}
+	return []dns.RR{
+		h.Signer.match(encloser, h.types(ctx, encloser, zone, class), class, ttl),
+		h.Signer.cover(next, class, ttl),
+		h.Signer.cover("*."+encloser, class, ttl),
 	}
+}
+
+// apex returns the apex of the zone name is in, or "" if the handler is not
+// authoritative for it. Every challenge name is the apex of its own zone, so
+// that the SOA lookup of DNS-01 solvers finds it, unless the zone is signed:
+// SOA and NS records signed below the apex would claim a zone cut the
+// parent does not delegate (RFC 4035 section 2.2), so with dnssec the
+// challenge names are ordinary names of the zone.
+func (h AcmeHandler) apex(name string) string {
+	zone := strings.ToLower(h.getQualifiedZone(h.Zone))
+	if checkDNSChallenge(name, zone) && h.Signer == nil {
+		return name
+	}
+	if dns.IsSubDomain(zone, name) {
+		return zone
+	}
+	return ""
+}
+
+// checkDNSChallenge reports whether name is the DNS-01 challenge name of a
+// name in zone. Both must be lower case and fully qualified.
+func checkDNSChallenge(name, zone string) bool {
+	return strings.HasPrefix(name, dnsChallengeString) && dns.IsSubDomain(zone, strings.TrimPrefix(name, dnsChallengeString))
+}
+
+func (h AcmeHandler) solveDNSChallenge(ctx context.Context, zone string, class uint16, a *dns.Msg) error {
+	a.Authoritative = true
+	records := h.provider.recordsAt(zone)
 	rrs := []dns.RR{}
-	log.Info(records)
 	for _, record := range records {
 		rr := new(dns.TXT)
 		rr.Txt = []string{record.Value}
-		rr.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: class, Ttl: uint32(record.TTL)}
+		rr.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: class}
 		rrs = append(rrs, rr)
 	}
 	a.Answer = append(a.Answer, rrs...)
 	return nil
 }
 
-func (h *AcmeHandler) handleSOA(ctx context.Context, name string, class uint16, a *dns.Msg) {
+func (h AcmeHandler) handleSOA(ctx context.Context, name string, class uint16, a *dns.Msg) {
 	rr := new(dns.SOA)
 	rr.Ns = h.AuthoritativeNameserver
-	rr.Mbox = h.getQualifiedZone(certificateAuthority)
+	if h.SOA.Mname != "" {
+		rr.Ns = h.SOA.Mname
+	}
+	rr.Mbox = "hostmaster." + h.getQualifiedZone(h.Zone)
+	if h.SOA.Rname != "" {
+		rr.Mbox = h.SOA.Rname
+	}
 	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: class}
-	rr.Serial = uint32(1)
-	rr.Expire = uint32(60)
-	rr.Minttl = uint32(60)
+	rr.Serial = h.provider.Serial()
+	rr.Refresh = orDefault(h.SOA.Refresh, defaultSOARefresh)
+	rr.Retry = orDefault(h.SOA.Retry, defaultSOARetry)
+	rr.Expire = orDefault(h.SOA.Expire, defaultSOAExpire)
+	rr.Minttl = orDefault(h.SOA.Minimum, defaultSOAMinimum)
 	a.Answer = append(a.Answer, rr)
 }
 
-func (h *AcmeHandler) handleA(ctx context.Context, name string, class uint16, a *dns.Msg) {
-	rr := new(dns.A)
-	rr.A = h.Ipv4Addr
-	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: class}
-	a.Answer = append(a.Answer, rr)
+func orDefault(value, fallback uint32) uint32 {
+	if value == 0 {
+		return fallback
+	}
+	return value
 }
 
-func (h *AcmeHandler) handleAAAA(ctx context.Context, name string, class uint16, a *dns.Msg) {
-	rr := new(dns.AAAA)
-	rr.AAAA = h.Ipv6Addr
-	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: class}
-	a.Answer = append(a.Answer, rr)
+// handleNS answers the NS set, adding the addresses of the nameservers
+// inside zone as glue.
+func (h AcmeHandler) handleNS(ctx context.Context, name, zone string, class uint16, a *dns.Msg) {
+	nameservers := h.Nameservers
+	if len(nameservers) == 0 && h.AuthoritativeNameserver != "" {
+		nameservers = []Nameserver{{Name: h.AuthoritativeNameserver}}
+	}
+	for _, ns := range nameservers {
+		rr := new(dns.NS)
+		rr.Ns = ns.Name
+		rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: class}
+		a.Answer = append(a.Answer, rr)
+		if dns.IsSubDomain(zone, strings.ToLower(ns.Name)) {
+			a.Extra = append(a.Extra, addressRecords(ns.Name, class, ns.Addresses)...)
+		}
+	}
+}
+
+// nameserver returns the nameserver of the zone named name, if it is inside
+// zone.
+func (h AcmeHandler) nameserver(name, zone string) (Nameserver, bool) {
+	for _, ns := range h.Nameservers {
+		if strings.EqualFold(ns.Name, name) && dns.IsSubDomain(zone, name) {
+			return ns, true
+		}
+	}
+	return Nameserver{}, false
+}
+
+// addressRecords returns the A and AAAA records of name for ips.
+func addressRecords(name string, class uint16, ips []net.IP) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: class}, A: ip4})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: class}, AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+func (h AcmeHandler) handleA(ctx context.Context, name string, class uint16, a *dns.Msg) {
+	for _, ip := range h.Ipv4Addrs {
+		rr := new(dns.A)
+		rr.A = ip
+		rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: class}
+		a.Answer = append(a.Answer, rr)
+	}
+}
+
+func (h AcmeHandler) handleAAAA(ctx context.Context, name string, class uint16, a *dns.Msg) {
+	for _, ip := range h.Ipv6Addrs {
+		rr := new(dns.AAAA)
+		rr.AAAA = ip
+		rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: class}
+		a.Answer = append(a.Answer, rr)
+	}
+}
+
+// setAddresses sets the addresses answered for A and AAAA queries. IPv4
+// addresses are only answered for A queries, so AAAA queries get NODATA
+// unless a real IPv6 address is known.
+func (h *AcmeHandler) setAddresses(addresses []net.IP) {
+	h.Ipv4Addrs, h.Ipv6Addrs = nil, nil
+	for _, ip := range addresses {
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			h.Ipv4Addrs = append(h.Ipv4Addrs, ip4)
+		} else {
+			h.Ipv6Addrs = append(h.Ipv6Addrs, ip)
+		}
+	}
 }
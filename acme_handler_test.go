@@ -0,0 +1,485 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+func TestReady(t *testing.T) {
+	if !(AcmeHandler{}).Ready() {
+		t.Errorf("Error: expected ready without wait_for_cert")
+	}
+	h := AcmeHandler{certReady: make(chan struct{})}
+	if h.Ready() {
+		t.Errorf("Error: expected not ready while waiting for the certificate")
+	}
+	close(h.certReady)
+	if !h.Ready() {
+		t.Errorf("Error: expected ready once the certificate is configured")
+	}
+}
+
+func TestServeDNSAuthoritative(t *testing.T) {
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	ctx := context.Background()
+	challenge := "_acme-challenge.www.test.domain."
+	if _, err := provider.AppendRecords(ctx, challenge, []libdns.Record{{Type: "TXT", Name: challenge, Value: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+	// fallthroughZones are the arguments of fallthrough, which is not set
+	// when they are nil
+	newHandler := func(fallthroughZones []string) AcmeHandler {
+		h := AcmeHandler{
+			Next:     plugintest.NextHandler(dns.RcodeRefused, nil),
+			provider: provider,
+			AcmeConfig: &AcmeConfig{
+				Zone:                    "test.domain",
+				Ipv4Addrs:               []net.IP{net.ParseIP("203.0.113.5").To4()},
+				AuthoritativeNameserver: "ns1.test.domain.",
+			},
+		}
+		if fallthroughZones != nil {
+			h.Fall.SetZonesFromArgs(fallthroughZones)
+		}
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		handler AcmeHandler
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+		soa     bool
+	}{
+		{"Apex A", newHandler(nil), "test.domain.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"Apex SOA", newHandler(nil), "TEST.domain.", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"Apex NODATA", newHandler(nil), "test.domain.", dns.TypeMX, dns.RcodeSuccess, 0, true},
+		{"Challenge TXT", newHandler(nil), challenge, dns.TypeTXT, dns.RcodeSuccess, 1, false},
+		{"Challenge without records", newHandler(nil), "_acme-challenge.test.domain.", dns.TypeTXT, dns.RcodeSuccess, 0, true},
+		{"Challenge NODATA", newHandler(nil), challenge, dns.TypeMX, dns.RcodeSuccess, 0, true},
+		{"Empty non-terminal", newHandler(nil), "www.test.domain.", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"Missing name", newHandler(nil), "missing.test.domain.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"Missing name with fallthrough", newHandler([]string{}), "missing.test.domain.", dns.TypeA, dns.RcodeRefused, 0, false},
+		{"Missing name outside fallthrough zones", newHandler([]string{"other.domain."}), "missing.test.domain.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"Other zone", newHandler(nil), "test.other.", dns.TypeA, dns.RcodeRefused, 0, false},
+		{"Challenge in a sibling zone", newHandler(nil), "_acme-challenge.other.domain.", dns.TypeTXT, dns.RcodeRefused, 0, false},
+		{"Challenge in a look-alike zone", newHandler(nil), "_acme-challenge.eviltest.domain.", dns.TypeNS, dns.RcodeRefused, 0, false},
+		{"Challenge in an unrelated zone", newHandler(nil), "_acme-challenge.anything.com.", dns.TypeA, dns.RcodeRefused, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(test.qname, test.qtype)
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+			rcode, err := test.handler.ServeDNS(ctx, rec, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Msg == nil {
+				if rcode != test.rcode {
+					t.Fatalf("Error: expected rcode %d but got %d", test.rcode, rcode)
+				}
+				return
+			}
+			resp := rec.Msg
+			if resp.Rcode != test.rcode || !resp.Authoritative {
+				t.Fatalf("Error: expected an authoritative reply with rcode %d but got %v", test.rcode, resp)
+			}
+			if len(resp.Answer) != test.answers {
+				t.Errorf("Error: expected %d answers but got %v", test.answers, resp.Answer)
+			}
+			if hasSOA := len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA; hasSOA != test.soa {
+				t.Errorf("Error: expected SOA in the authority section %v but got %v", test.soa, resp.Ns)
+			}
+		})
+	}
+}
+
+func TestCheckDNSChallenge(t *testing.T) {
+	tests := []struct {
+		name      string
+		qname     string
+		zone      string
+		challenge bool
+	}{
+		{"Zone apex", "_acme-challenge.test.domain.", "test.domain.", true},
+		{"Name in zone", "_acme-challenge.www.test.domain.", "test.domain.", true},
+		{"Name two labels deep in zone", "_acme-challenge.a.b.test.domain.", "test.domain.", true},
+		{"Sibling zone", "_acme-challenge.other.domain.", "test.domain.", false},
+		{"Parent zone", "_acme-challenge.domain.", "test.domain.", false},
+		{"Look-alike suffix", "_acme-challenge.eviltest.domain.", "test.domain.", false},
+		{"Zone as a label", "_acme-challenge.test.domain.evil.", "test.domain.", false},
+		{"Unrelated zone", "_acme-challenge.anything.com.", "test.domain.", false},
+		{"Not a challenge", "acme-challenge.test.domain.", "test.domain.", false},
+		{"Challenge label inside the name", "www._acme-challenge.test.domain.", "test.domain.", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if challenge := checkDNSChallenge(test.qname, test.zone); challenge != test.challenge {
+				t.Errorf("Error: checkDNSChallenge(%s, %s) = %v, expected %v", test.qname, test.zone, challenge, test.challenge)
+			}
+		})
+	}
+}
+
+func TestHandleSOA(t *testing.T) {
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	h := AcmeHandler{provider: provider, AcmeConfig: &AcmeConfig{Zone: "test.domain", AuthoritativeNameserver: "ns1.test.domain."}}
+	soa := func() *dns.SOA {
+		a := new(dns.Msg)
+		h.handleSOA(context.Background(), "test.domain.", dns.ClassINET, a)
+		return a.Answer[0].(*dns.SOA)
+	}
+	defaults := soa()
+	if defaults.Ns != "ns1.test.domain." || defaults.Mbox != "hostmaster.test.domain." || defaults.Refresh != defaultSOARefresh ||
+		defaults.Retry != defaultSOARetry || defaults.Expire != defaultSOAExpire || defaults.Minttl != defaultSOAMinimum {
+		t.Errorf("Error: expected the default SOA fields but got %v", defaults)
+	}
+	if _, err := provider.AppendRecords(context.Background(), "_acme-challenge.test.domain.", []libdns.Record{{Type: "TXT", Value: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+	if serial := soa().Serial; serial <= defaults.Serial {
+		t.Errorf("Error: expected the serial to increase with the records, got %d then %d", defaults.Serial, serial)
+	}
+
+	h.SOA = SOAConfig{Mname: "primary.test.domain.", Rname: "dns-admin.test.domain.", Refresh: 7200, Retry: 900, Expire: 1209600, Minimum: 300}
+	configured := soa()
+	if configured.Ns != "primary.test.domain." || configured.Mbox != "dns-admin.test.domain." || configured.Refresh != 7200 ||
+		configured.Retry != 900 || configured.Expire != 1209600 || configured.Minttl != 300 {
+		t.Errorf("Error: expected the configured SOA fields but got %v", configured)
+	}
+}
+
+func TestHandleAddresses(t *testing.T) {
+	h := AcmeHandler{AcmeConfig: &AcmeConfig{Zone: "test.domain"}}
+	h.setAddresses([]net.IP{net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5"), net.ParseIP("198.51.100.7"), net.ParseIP("2001:db8::7")})
+	a := new(dns.Msg)
+	h.handleA(context.Background(), "test.domain.", dns.ClassINET, a)
+	if len(a.Answer) != 2 || !a.Answer[0].(*dns.A).A.Equal(net.ParseIP("203.0.113.5")) || !a.Answer[1].(*dns.A).A.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("Error: expected both IPv4 addresses but got %v", a.Answer)
+	}
+	aaaa := new(dns.Msg)
+	h.handleAAAA(context.Background(), "test.domain.", dns.ClassINET, aaaa)
+	if len(aaaa.Answer) != 2 || !aaaa.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::5")) || !aaaa.Answer[1].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("Error: expected both IPv6 addresses but got %v", aaaa.Answer)
+	}
+}
+
+func TestServeDNSAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []net.IP
+		a, aaaa   int
+	}{
+		{"IPv4 only", []net.IP{net.ParseIP("203.0.113.5")}, 1, 0},
+		{"IPv6 only", []net.IP{net.ParseIP("2001:db8::5")}, 0, 1},
+		{"Dual stack", []net.IP{net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5")}, 1, 1},
+		{"Nothing known", nil, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := AcmeHandler{
+				Next:       plugintest.NextHandler(dns.RcodeRefused, nil),
+				provider:   &Provider{recordMap: make(map[string]*RecordStore)},
+				AcmeConfig: &AcmeConfig{Zone: "test.domain", AuthoritativeNameserver: "ns1.test.domain."},
+			}
+			h.setAddresses(test.addresses)
+			for qtype, expected := range map[uint16]int{dns.TypeA: test.a, dns.TypeAAAA: test.aaaa} {
+				req := new(dns.Msg)
+				req.SetQuestion("test.domain.", qtype)
+				rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+				if _, err := h.ServeDNS(context.Background(), rec, req); err != nil {
+					t.Fatal(err)
+				}
+				resp := rec.Msg
+				if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != expected {
+					t.Fatalf("Error: expected %d %s answers but got %v", expected, dns.TypeToString[qtype], resp)
+				}
+				for _, rr := range resp.Answer {
+					if aaaa, ok := rr.(*dns.AAAA); ok && aaaa.AAAA.To4() != nil {
+						t.Errorf("Error: expected a real IPv6 address but got %v", aaaa.AAAA)
+					}
+				}
+				if expected == 0 && (len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA) {
+					t.Errorf("Error: expected NODATA with the SOA for %s but got %v", dns.TypeToString[qtype], resp)
+				}
+			}
+		})
+	}
+}
+
+func TestServeDNSTTLs(t *testing.T) {
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	challenge := "_acme-challenge.test.domain."
+	if _, err := provider.AppendRecords(context.Background(), challenge, []libdns.Record{{Type: "TXT", Name: challenge, Value: "token", TTL: time.Minute}}); err != nil {
+		t.Fatal(err)
+	}
+	newHandler := func(ttl TTLConfig, soa SOAConfig) AcmeHandler {
+		h := AcmeHandler{
+			provider:   provider,
+			AcmeConfig: &AcmeConfig{Zone: "test.domain", AuthoritativeNameserver: "ns1.test.domain.", TTL: ttl, SOA: soa},
+		}
+		h.setAddresses([]net.IP{net.ParseIP("203.0.113.5")})
+		return h
+	}
+	configured := newHandler(TTLConfig{Apex: 86400, Challenge: 5, Negative: 120}, SOAConfig{Minimum: 300})
+
+	tests := []struct {
+		name    string
+		handler AcmeHandler
+		qname   string
+		qtype   uint16
+		ttl     uint32
+	}{
+		{"Default apex", newHandler(TTLConfig{}, SOAConfig{}), "test.domain.", dns.TypeA, defaultApexTTL},
+		{"Default challenge", newHandler(TTLConfig{}, SOAConfig{}), challenge, dns.TypeTXT, defaultChallengeTTL},
+		{"Default negative", newHandler(TTLConfig{}, SOAConfig{}), "missing.test.domain.", dns.TypeA, defaultNegativeTTL},
+		{"Negative capped at the SOA minimum", newHandler(TTLConfig{}, SOAConfig{Minimum: 10}), "test.domain.", dns.TypeMX, 10},
+		{"Configured apex", configured, "test.domain.", dns.TypeSOA, 86400},
+		{"Configured challenge", configured, challenge, dns.TypeTXT, 5},
+		{"Configured challenge SOA", configured, challenge, dns.TypeSOA, 5},
+		{"Configured negative", configured, "missing.test.domain.", dns.TypeA, 120},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(test.qname, test.qtype)
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+			if _, err := test.handler.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+			rrs := append(rec.Msg.Answer, rec.Msg.Ns...)
+			if len(rrs) == 0 {
+				t.Fatalf("Error: expected records but got %v", rec.Msg)
+			}
+			for _, rr := range rrs {
+				if rr.Header().Ttl != test.ttl {
+					t.Errorf("Error: expected TTL %d but got %v", test.ttl, rr)
+				}
+			}
+		})
+	}
+}
+
+func TestServeDNSNameservers(t *testing.T) {
+	h := AcmeHandler{
+		Next:     plugintest.NextHandler(dns.RcodeRefused, nil),
+		provider: &Provider{recordMap: make(map[string]*RecordStore)},
+		AcmeConfig: &AcmeConfig{
+			Zone:                    "test.domain",
+			AuthoritativeNameserver: "ns2.test.domain.",
+			Nameservers: []Nameserver{
+				{Name: "ns1.test.domain.", Addresses: []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}},
+				{Name: "ns2.test.domain.", Addresses: []net.IP{net.ParseIP("203.0.113.2")}},
+				{Name: "ns.provider.example."},
+			},
+		},
+	}
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+		extra   int
+	}{
+		{"Apex NS", "test.domain.", dns.TypeNS, dns.RcodeSuccess, 3, 3},
+		{"Challenge NS", "_acme-challenge.www.test.domain.", dns.TypeNS, dns.RcodeSuccess, 3, 3},
+		{"In-bailiwick nameserver A", "ns1.test.domain.", dns.TypeA, dns.RcodeSuccess, 1, 0},
+		{"In-bailiwick nameserver AAAA", "ns1.test.domain.", dns.TypeAAAA, dns.RcodeSuccess, 1, 0},
+		{"In-bailiwick nameserver without AAAA", "ns2.test.domain.", dns.TypeAAAA, dns.RcodeSuccess, 0, 0},
+		{"Missing nameserver", "ns3.test.domain.", dns.TypeA, dns.RcodeNameError, 0, 0},
+		{"Out-of-bailiwick nameserver", "ns.provider.example.", dns.TypeA, dns.RcodeRefused, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(test.qname, test.qtype)
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+			rcode, err := h.ServeDNS(context.Background(), rec, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Msg == nil {
+				if rcode != test.rcode {
+					t.Fatalf("Error: expected rcode %d but got %d", test.rcode, rcode)
+				}
+				return
+			}
+			resp := rec.Msg
+			if resp.Rcode != test.rcode || len(resp.Answer) != test.answers || len(resp.Extra) != test.extra {
+				t.Fatalf("Error: expected rcode %d with %d answers and %d glue records but got %v", test.rcode, test.answers, test.extra, resp)
+			}
+			for _, rr := range resp.Extra {
+				if !dns.IsSubDomain("test.domain.", rr.Header().Name) {
+					t.Errorf("Error: expected glue only for nameservers inside the zone but got %v", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestServeDNSDNSSEC(t *testing.T) {
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	ctx := context.Background()
+	challenge := "_acme-challenge.www.test.domain."
+	if _, err := provider.AppendRecords(ctx, challenge, []libdns.Record{{Type: "TXT", Name: challenge, Value: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+	signer := &ZoneSigner{Zone: "test.domain.", Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	if err := signer.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h := AcmeHandler{
+		Next:     plugintest.NextHandler(dns.RcodeRefused, nil),
+		provider: provider,
+		AcmeConfig: &AcmeConfig{
+			Zone:                    "test.domain",
+			Ipv4Addrs:               []net.IP{net.ParseIP("203.0.113.5").To4()},
+			AuthoritativeNameserver: "ns1.test.domain.",
+			Signer:                  signer,
+		},
+	}
+	keys := map[uint16]*dns.DNSKEY{}
+	for _, rr := range signer.dnskeys(dns.ClassINET) {
+		keys[rr.(*dns.DNSKEY).KeyTag()] = rr.(*dns.DNSKEY)
+	}
+	// verify checks the signature of every RRset of a section
+	verify := func(t *testing.T, section []dns.RR) {
+		rrsets := map[string][]dns.RR{}
+		var sigs []*dns.RRSIG
+		for _, rr := range section {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs = append(sigs, sig)
+				continue
+			}
+			key := rr.Header().Name + dns.TypeToString[rr.Header().Rrtype]
+			rrsets[key] = append(rrsets[key], rr)
+		}
+		if len(sigs) != len(rrsets) {
+			t.Fatalf("Error: expected a signature for each of %d RRsets but got %d", len(rrsets), len(sigs))
+		}
+		for _, sig := range sigs {
+			rrset := rrsets[sig.Hdr.Name+dns.TypeToString[sig.TypeCovered]]
+			if err := sig.Verify(keys[sig.KeyTag], rrset); err != nil {
+				t.Errorf("Error: signature of %v does not verify: %v", rrset, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		do      bool
+		rcode   int
+		answers int
+		nsec3   int
+	}{
+		{"Challenge TXT", challenge, dns.TypeTXT, true, dns.RcodeSuccess, 1, 0},
+		{"Challenge TXT without DO", challenge, dns.TypeTXT, false, dns.RcodeSuccess, 1, 0},
+		{"Apex DNSKEY", "test.domain.", dns.TypeDNSKEY, true, dns.RcodeSuccess, 2, 0},
+		{"Apex DNSKEY without DO", "test.domain.", dns.TypeDNSKEY, false, dns.RcodeSuccess, 2, 0},
+		{"Apex NSEC3PARAM", "test.domain.", dns.TypeNSEC3PARAM, true, dns.RcodeSuccess, 1, 0},
+		{"Apex NODATA", "test.domain.", dns.TypeMX, true, dns.RcodeSuccess, 0, 1},
+		{"Challenge DS", challenge, dns.TypeDS, true, dns.RcodeSuccess, 0, 1},
+		{"Challenge NS", challenge, dns.TypeNS, true, dns.RcodeSuccess, 0, 1},
+		{"Challenge name without records", "_acme-challenge.missing.test.domain.", dns.TypeTXT, true, dns.RcodeNameError, 0, 3},
+		{"Empty non-terminal", "www.test.domain.", dns.TypeA, true, dns.RcodeSuccess, 0, 1},
+		{"Missing name", "missing.test.domain.", dns.TypeA, true, dns.RcodeNameError, 0, 3},
+		{"Missing name without DO", "missing.test.domain.", dns.TypeA, false, dns.RcodeNameError, 0, 0},
+		{"Missing name below an empty non-terminal", "a.b.www.test.domain.", dns.TypeA, true, dns.RcodeNameError, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(test.qname, test.qtype)
+			req.SetEdns0(dns.DefaultMsgSize, test.do)
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+			if _, err := h.ServeDNS(ctx, rec, req); err != nil {
+				t.Fatal(err)
+			}
+			resp := rec.Msg
+			var answers, sigs, nsec3 int
+			for _, rr := range append(resp.Answer, resp.Ns...) {
+				switch rr := rr.(type) {
+				case *dns.RRSIG:
+					sigs++
+				case *dns.NSEC3:
+					nsec3++
+					if test.rcode == dns.RcodeNameError && rr.Match(test.qname) {
+						t.Errorf("Error: expected no NSEC3 record to match %s but got %v", test.qname, rr)
+					}
+					if test.rcode == dns.RcodeSuccess && (!rr.Match(test.qname) || hasType(rr.TypeBitMap, test.qtype)) {
+						t.Errorf("Error: expected an NSEC3 record of %s without type %d but got %v", test.qname, test.qtype, rr)
+					}
+				default:
+					if rr.Header().Rrtype == test.qtype {
+						answers++
+					}
+				}
+			}
+			if resp.Rcode != test.rcode || answers != test.answers || nsec3 != test.nsec3 {
+				t.Fatalf("Error: expected rcode %d with %d answers and %d NSEC3 records but got %v", test.rcode, test.answers, test.nsec3, resp)
+			}
+			if !test.do {
+				if sigs != 0 {
+					t.Errorf("Error: expected no signatures without the DO bit but got %v", resp)
+				}
+				return
+			}
+			if opt := resp.IsEdns0(); opt == nil || !opt.Do() {
+				t.Errorf("Error: expected the DO bit in the response but got %v", resp)
+			}
+			verify(t, resp.Answer)
+			verify(t, resp.Ns)
+		})
+	}
+
+	// a challenge name is not a zone cut: the SOA of a negative answer is
+	// the apex's and its NSEC3 type bit map has no SOA or NS
+	req := new(dns.Msg)
+	req.SetQuestion(challenge, dns.TypeMX)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := h.ServeDNS(ctx, rec, req); err != nil {
+		t.Fatal(err)
+	}
+	var nsec3 *dns.NSEC3
+	for _, rr := range rec.Msg.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if rr.Hdr.Name != "test.domain." {
+				t.Errorf("Error: expected the SOA of test.domain. but got %v", rr)
+			}
+		case *dns.NSEC3:
+			nsec3 = rr
+		}
+	}
+	if nsec3 == nil {
+		t.Fatalf("Error: expected an NSEC3 record for %s but got %v", challenge, rec.Msg)
+	}
+	if !hasType(nsec3.TypeBitMap, dns.TypeTXT) || !hasType(nsec3.TypeBitMap, dns.TypeRRSIG) ||
+		hasType(nsec3.TypeBitMap, dns.TypeSOA) || hasType(nsec3.TypeBitMap, dns.TypeNS) {
+		t.Errorf("Error: expected the types of %s to be TXT and RRSIG without SOA or NS but got %v", challenge, nsec3)
+	}
+}
+
+func hasType(types []uint16, qtype uint16) bool {
+	for _, typ := range types {
+		if typ == qtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package acme
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// ApprovalRequest is a queued request for a certificate for a new name.
+type ApprovalRequest struct {
+	Name        string    `json:"name"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	KeyType     string    `json:"key_type"`
+	Requested   time.Time `json:"requested"`
+	Status      string    `json:"status"`
+	Decided     time.Time `json:"decided,omitempty"`
+	DecidedBy   string    `json:"decided_by,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// AuditEntry records a decision on an approval request.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Action string    `json:"action"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// ApprovalError is returned instead of placing an order for a name that
+// has not been approved.
+type ApprovalError struct {
+	Name   string
+	Status string
+}
+
+func (e ApprovalError) Error() string {
+	if e.Status == ApprovalRejected {
+		return fmt.Sprintf("certificate for %s was rejected", e.Name)
+	}
+	return fmt.Sprintf("certificate for %s is awaiting approval", e.Name)
+}
+
+// ApprovalQueue holds orders for new names until a person approves them.
+// Once a name is approved its renewals go ahead without approval. The queue
+// and its audit trail are kept in certmagic storage.
+type ApprovalQueue struct {
+	Storage certmagic.Storage
+	// Policy refuses approvals of names it denies.
+	Policy *NamePolicy
+	// Tokens maps the bearer tokens ServeHTTP accepts to the administrator
+	// holding each, who is recorded as having made their decisions.
+	Tokens map[string]string
+	// ClientCAs verify the client certificates ServeHTTP accepts, whose
+	// common name is recorded as having made their decisions. Verifying is
+	// up to the TLS listener, set up by require_approval.
+	ClientCAs *x509.CertPool
+
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func approvalPrefix() string {
+	return path.Join(storagePrefix, "approvals")
+}
+
+func (q *ApprovalQueue) key(name string) string {
+	return path.Join(approvalPrefix(), "requests", certmagic.StorageKeys.Safe(name)+".json")
+}
+
+func (q *ApprovalQueue) auditKey() string {
+	return path.Join(approvalPrefix(), "audit.json")
+}
+
+// Check returns nil if csr may be ordered, queueing it for approval
+// otherwise.
+func (q *ApprovalQueue) Check(csr *x509.CertificateRequest) error {
+	name := csrName(csr)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	request, err := q.load(q.key(name))
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		if q.grandfathered(name) {
+			return nil
+		}
+		request = ApprovalRequest{Name: name, KeyType: keyType(csr.PublicKey), Requested: time.Now(), Status: ApprovalPending}
+		request.DNSNames = csr.DNSNames
+		for _, ip := range csr.IPAddresses {
+			request.IPAddresses = append(request.IPAddresses, ip.String())
+		}
+		if err := q.store(request); err != nil {
+			return err
+		}
+		log.Infof("Certificate for %s queued for approval", name)
+	} else if err != nil {
+		return err
+	}
+	if request.Status == ApprovalApproved {
+		return nil
+	}
+	return ApprovalError{Name: name, Status: request.Status}
+}
+
+// grandfathered reports whether name already had a certificate before
+// approval was required, which then renews without approval.
+func (q *ApprovalQueue) grandfathered(name string) bool {
+	inventory := &Inventory{Storage: q.Storage}
+	status, err := inventory.Get(name)
+	return err == nil && status.Serial != ""
+}
+
+// List returns every request, pending ones first.
+func (q *ApprovalQueue) List() ([]ApprovalRequest, error) {
+	keys, err := q.Storage.List(path.Join(approvalPrefix(), "requests"), false)
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var requests []ApprovalRequest
+	for _, key := range keys {
+		request, err := q.load(key)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if (requests[i].Status == ApprovalPending) != (requests[j].Status == ApprovalPending) {
+			return requests[i].Status == ApprovalPending
+		}
+		return requests[i].Requested.Before(requests[j].Requested)
+	})
+	return requests, nil
+}
+
+// Approve lets the certificate for name be ordered and renewed.
+func (q *ApprovalQueue) Approve(name, by, reason string) error {
+	if err := q.Policy.Check([]string{name}); err != nil {
+		return err
+	}
+	return q.decide(name, ApprovalApproved, by, reason)
+}
+
+// Reject refuses the certificate for name until it is approved.
+func (q *ApprovalQueue) Reject(name, by, reason string) error {
+	return q.decide(name, ApprovalRejected, by, reason)
+}
+
+func (q *ApprovalQueue) decide(name, status, by, reason string) error {
+	if by == "" {
+		return fmt.Errorf("a decision on %s must name who made it", name)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	request, err := q.load(q.key(name))
+	if err != nil {
+		return err
+	}
+	request.Status, request.Decided, request.DecidedBy, request.Reason = status, time.Now(), by, reason
+	if err := q.audit(AuditEntry{Time: request.Decided, Name: name, Action: status, By: by, Reason: reason}); err != nil {
+		return err
+	}
+	if err := q.store(request); err != nil {
+		return err
+	}
+	log.Infof("Certificate for %s %s by %s", name, status, by)
+	if waiter, ok := q.waiters[name]; ok {
+		close(waiter)
+		delete(q.waiters, name)
+	}
+	return nil
+}
+
+// Audit returns every decision made, oldest first.
+func (q *ApprovalQueue) Audit() ([]AuditEntry, error) {
+	var entries []AuditEntry
+	data, err := q.Storage.Load(q.auditKey())
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("decoding approval audit: %v", err)
+	}
+	return entries, nil
+}
+
+func (q *ApprovalQueue) audit(entry AuditEntry) error {
+	ctx := context.Background()
+	if err := q.Storage.Lock(ctx, q.auditKey()); err != nil {
+		return err
+	}
+	defer q.Storage.Unlock(q.auditKey())
+	entries, err := q.Audit()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(append(entries, entry))
+	if err != nil {
+		return err
+	}
+	return q.Storage.Store(q.auditKey(), data)
+}
+
+// decided returns a channel that is closed once the request for name is no
+// longer pending.
+func (q *ApprovalQueue) decided(name string) <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if request, err := q.load(q.key(name)); err != nil || request.Status != ApprovalPending {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if q.waiters == nil {
+		q.waiters = make(map[string]chan struct{})
+	}
+	waiter, ok := q.waiters[name]
+	if !ok {
+		waiter = make(chan struct{})
+		q.waiters[name] = waiter
+	}
+	return waiter
+}
+
+func (q *ApprovalQueue) load(key string) (ApprovalRequest, error) {
+	var request ApprovalRequest
+	data, err := q.Storage.Load(key)
+	if err != nil {
+		return request, err
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return request, fmt.Errorf("decoding approval request %s: %v", key, err)
+	}
+	return request, nil
+}
+
+func (q *ApprovalQueue) store(request ApprovalRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return q.Storage.Store(q.key(request.Name), data)
+}
+
+// ServeHTTP is the admin endpoint of the queue:
+//
+//	GET  /approvals                  lists the requests
+//	GET  /approvals/audit            lists the decisions
+//	POST /approvals/<name>/approve   approves a request
+//	POST /approvals/<name>/reject    rejects a request
+//
+// reason may be given as a form value with a decision. With Tokens or
+// ClientCAs every request must be authenticated, and decisions are
+// recorded as made by the authenticated administrator. Without them the
+// endpoint only listens on loopback and the by form value names who
+// decided.
+func (q *ApprovalQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "approvals" {
+		http.NotFound(w, r)
+		return
+	}
+	var by string
+	if q.authenticated() {
+		by = q.identity(r)
+		if by == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="approvals"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		requests, err := q.List()
+		writeJSON(w, requests, err)
+	case len(parts) == 2 && parts[1] == "audit" && r.Method == http.MethodGet:
+		entries, err := q.Audit()
+		writeJSON(w, entries, err)
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		if by == "" {
+			by = r.FormValue("by")
+		}
+		if by == "" {
+			http.Error(w, "by is required", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch parts[2] {
+		case "approve":
+			err = q.Approve(parts[1], by, r.FormValue("reason"))
+		case "reject":
+			err = q.Reject(parts[1], by, r.FormValue("reason"))
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if _, ok := err.(certmagic.ErrNotExist); ok {
+			http.Error(w, fmt.Sprintf("no approval request for %s", parts[1]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (q *ApprovalQueue) authenticated() bool {
+	return len(q.Tokens) > 0 || q.ClientCAs != nil
+}
+
+// identity returns the administrator r was authenticated as, by its
+// verified client certificate or its bearer token, or "" if it was not.
+func (q *ApprovalQueue) identity(r *http.Request) string {
+	if q.ClientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for token, name := range q.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), presented) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// readApprovalTokens reads a file of administrators and their bearer
+// tokens, one "NAME TOKEN" pair per line. Blank lines and lines starting
+// with # are skipped.
+func readApprovalTokens(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected NAME TOKEN", file, i+1)
+		}
+		if _, ok := tokens[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: token of %s is already given", file, i+1, fields[0])
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s holds no tokens", file)
+	}
+	return tokens, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,278 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestApprovalQueue(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	queue := &ApprovalQueue{Storage: storage}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrFor := func(name string) *x509.CertificateRequest {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+
+	var approvalErr ApprovalError
+	if err := queue.Check(csrFor("new.test.domain")); !errors.As(err, &approvalErr) || approvalErr.Status != ApprovalPending {
+		t.Fatalf("Error: expected new.test.domain to await approval but got %v", err)
+	}
+	if err := queue.Check(csrFor("other.test.domain")); err == nil {
+		t.Fatal("Error: expected other.test.domain to await approval")
+	}
+	requests, err := queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[0].Name != "new.test.domain" || requests[0].KeyType != "ECDSA P-256" || requests[0].DNSNames[0] != "new.test.domain" {
+		t.Fatalf("Error: expected requests for new.test.domain and other.test.domain but got %+v", requests)
+	}
+
+	decided := queue.decided("new.test.domain")
+	if err := queue.Approve("new.test.domain", "", ""); err == nil {
+		t.Fatal("Error: expected an approval without an approver to fail")
+	}
+	if err := queue.Approve("new.test.domain", "alice", "change 42"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-decided:
+	case <-time.After(time.Second):
+		t.Fatal("Error: expected the approval to be signalled")
+	}
+	if err := queue.Reject("other.test.domain", "bob", "not ours"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted queue sees the same decisions
+	queue = &ApprovalQueue{Storage: storage}
+	if err := queue.Check(csrFor("new.test.domain")); err != nil {
+		t.Fatalf("Error: expected the approved name to renew but got %v", err)
+	}
+	if err := queue.Check(csrFor("other.test.domain")); !errors.As(err, &approvalErr) || approvalErr.Status != ApprovalRejected {
+		t.Fatalf("Error: expected other.test.domain to stay rejected but got %v", err)
+	}
+	entries, err := queue.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != ApprovalApproved || entries[0].By != "alice" || entries[0].Reason != "change 42" ||
+		entries[1].Action != ApprovalRejected || entries[1].By != "bob" {
+		t.Fatalf("Error: expected the approval and rejection to be audited but got %+v", entries)
+	}
+
+	// names that had a certificate before approval was required renew
+	inventory := &Inventory{Storage: storage}
+	if err := inventory.update("old.test.domain", func(status *CertificateStatus) { status.Serial = "1" }); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Check(csrFor("old.test.domain")); err != nil {
+		t.Fatalf("Error: expected old.test.domain to renew without approval but got %v", err)
+	}
+}
+
+func TestApprovalQueueHTTP(t *testing.T) {
+	queue := &ApprovalQueue{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	if err := queue.store(ApprovalRequest{Name: "new.test.domain", Status: ApprovalPending, Requested: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(queue)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/approvals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []ApprovalRequest
+	err = json.NewDecoder(resp.Body).Decode(&requests)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Name != "new.test.domain" {
+		t.Fatalf("Error: expected the pending request but got %+v", requests)
+	}
+
+	tests := []struct {
+		path   string
+		form   url.Values
+		status int
+	}{
+		{"/approvals/new.test.domain/approve", url.Values{}, http.StatusBadRequest},
+		{"/approvals/unknown.test.domain/approve", url.Values{"by": {"alice"}}, http.StatusNotFound},
+		{"/approvals/new.test.domain/ignore", url.Values{"by": {"alice"}}, http.StatusNotFound},
+		{"/approvals/new.test.domain/approve", url.Values{"by": {"alice"}}, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(server.URL+test.path, "application/x-www-form-urlencoded", strings.NewReader(test.form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("Error: expected %d for %s but got %d", test.status, test.path, resp.StatusCode)
+		}
+	}
+	entries, err := queue.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].By != "alice" {
+		t.Fatalf("Error: expected the approval to be audited but got %+v", entries)
+	}
+}
+
+func TestApprovalQueueAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	tokensFile := filepath.Join(dir, "approvers")
+	if err := ioutil.WriteFile(tokensFile, []byte("# administrators\nalice s3cret-alice\n\nbob s3cret-bob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := readApprovalTokens(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["s3cret-bob"] != "bob" {
+		t.Fatalf("Error: expected the tokens of alice and bob but got %v", tokens)
+	}
+	queue := &ApprovalQueue{Storage: &certmagic.FileStorage{Path: dir}, Tokens: tokens}
+	for _, name := range []string{"a.test.domain", "b.test.domain"} {
+		if err := queue.store(ApprovalRequest{Name: name, Status: ApprovalPending, Requested: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(queue)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"List without a token", http.MethodGet, "/approvals", "", http.StatusUnauthorized},
+		{"List with a wrong token", http.MethodGet, "/approvals", "guess", http.StatusUnauthorized},
+		{"List", http.MethodGet, "/approvals", "s3cret-alice", http.StatusOK},
+		{"Approve without a token", http.MethodPost, "/approvals/a.test.domain/approve", "", http.StatusUnauthorized},
+		// the caller-supplied by is ignored
+		{"Approve", http.MethodPost, "/approvals/a.test.domain/approve?by=mallory", "s3cret-bob", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("Error: expected %d but got %d", test.status, resp.StatusCode)
+			}
+		})
+	}
+	entries, err := queue.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].By != "bob" {
+		t.Fatalf("Error: expected the approval to be recorded as made by bob but got %+v", entries)
+	}
+}
+
+func TestApprovalQueueClientCertificates(t *testing.T) {
+	ca := &InternalCA{Storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	if err := ca.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.root)
+	queue := &ApprovalQueue{Storage: &certmagic.FileStorage{Path: t.TempDir()}, ClientCAs: clientCAs}
+	if err := queue.store(ApprovalRequest{Name: "a.test.domain", Status: ApprovalPending, Requested: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(queue)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "carol"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.intermediate, key.Public(), ca.interKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.Client()
+	anonymous := &http.Client{Transport: client.Transport.(*http.Transport).Clone()}
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{der, ca.intermediate.Raw},
+		PrivateKey:  key,
+	}}
+
+	resp, err := anonymous.Post(server.URL+"/approvals/a.test.domain/approve?by=mallory", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Error: expected a request without a client certificate to be refused but got %d", resp.StatusCode)
+	}
+	resp, err = client.Post(server.URL+"/approvals/a.test.domain/approve", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Error: expected the approval to be accepted but got %d", resp.StatusCode)
+	}
+	entries, err := queue.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].By != "carol" {
+		t.Fatalf("Error: expected the approval to be recorded as made by carol but got %+v", entries)
+	}
+}
@@ -0,0 +1,166 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mholt/acmez/acme"
+)
+
+// authzCleanupTimeout bounds the cleanup after a failed order, which runs
+// even when the order failed because its context was done.
+const authzCleanupTimeout = time.Minute
+
+// errNoAccount is returned when no ACME account is stored for the issuer's
+// CA.
+var errNoAccount = errors.New("no ACME account stored")
+
+// authzCleanup summarizes what was cleaned up after a failed order.
+type authzCleanup struct {
+	Deactivated map[string]int
+	Records     int
+}
+
+func (s authzCleanup) String() string {
+	return fmt.Sprintf("deactivated %d pending and %d valid authorizations, removed %d challenge records",
+		s.Deactivated[acme.StatusPending], s.Deactivated[acme.StatusValid], s.Records)
+}
+
+// cleanUpAuthorizations cleans up after a failed or abandoned order for
+// csr: it removes its challenge records and journaled challenges, and
+// deactivates the authorization the CA reported the failure for, which the
+// CA would otherwise hand back to later orders. acmez deactivates the
+// other authorizations of the order itself.
+func (i acmeIssuer) cleanUpAuthorizations(csr *x509.CertificateRequest, orderErr error) (authzCleanup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), authzCleanupTimeout)
+	defer cancel()
+	summary := authzCleanup{Deactivated: make(map[string]int)}
+	values := make(map[string]bool)
+	for _, name := range csr.DNSNames {
+		// authorizations for wildcards are for the base domain
+		values[strings.TrimPrefix(strings.ToLower(name), "*.")] = true
+		if i.provider != nil {
+			summary.Records += i.provider.clearChallenge(ctx, name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		values[ip.String()] = true
+	}
+	if i.provider != nil && i.provider.journal != nil {
+		if err := i.provider.journal.forgetIdentifiers(ctx, values, i.provider); err != nil {
+			return summary, err
+		}
+	}
+
+	var urls []string
+	var problem acme.Problem
+	if errors.As(orderErr, &problem) {
+		if authz, ok := problem.Resource.(acme.Authorization); ok && authz.Location != "" {
+			urls = append(urls, authz.Location)
+		}
+	}
+	if len(urls) == 0 {
+		return summary, nil
+	}
+	account, err := i.account(ctx)
+	if err != nil {
+		return summary, err
+	}
+	client := &acme.Client{Directory: i.CA}
+	err = deactivateAuthorizations(ctx, client, account, urls, summary.Deactivated)
+	return summary, err
+}
+
+// skipCleanUp reports whether a failed order is better left alone: when the
+// CA rate limited it or could not be reached, no authorization was left
+// behind that cleaning up could reach.
+func skipCleanUp(err error) bool {
+	var problem acme.Problem
+	if errors.As(err, &problem) && problem.Type == acme.ProblemTypeRateLimited {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// deactivateAuthorizations deactivates the authorizations at urls that are
+// pending or valid, counting them by their status before deactivation.
+func deactivateAuthorizations(ctx context.Context, client *acme.Client, account acme.Account, urls []string, deactivated map[string]int) error {
+	for _, url := range urls {
+		authz, err := client.GetAuthorization(ctx, account, url)
+		if err != nil {
+			return err
+		}
+		if authz.Status != acme.StatusPending && authz.Status != acme.StatusValid {
+			continue
+		}
+		if _, err := client.DeactivateAuthorization(ctx, account, url); err != nil {
+			return err
+		}
+		deactivated[authz.Status]++
+	}
+	return nil
+}
+
+// account loads the ACME account certmagic registered for the issuer's CA,
+// preferring the one for its configured email.
+func (i acmeIssuer) account(ctx context.Context) (acme.Account, error) {
+	storage := i.ledger.Storage
+	usersPrefix := path.Join("acme", certmagic.StorageKeys.Safe(i.IssuerKey()), "users")
+	users, err := storage.List(usersPrefix, false)
+	if _, ok := err.(certmagic.ErrNotExist); ok || os.IsNotExist(err) {
+		users, err = nil, nil
+	}
+	if err != nil {
+		return acme.Account{}, err
+	}
+	email := "default"
+	if i.Email != "" {
+		email = certmagic.StorageKeys.Safe(strings.ToLower(i.Email))
+	}
+	for _, preferred := range []bool{true, false} {
+		for _, user := range users {
+			if preferred != (path.Base(user) == email) {
+				continue
+			}
+			keys, err := storage.List(user, false)
+			if err != nil {
+				continue
+			}
+			for _, key := range keys {
+				if !strings.HasSuffix(key, ".key") {
+					continue
+				}
+				keyPEM, err := storage.Load(key)
+				if err != nil {
+					continue
+				}
+				return i.ACMEManager.GetAccount(ctx, keyPEM)
+			}
+		}
+	}
+	return acme.Account{}, fmt.Errorf("%w for %s", errNoAccount, i.CA)
+}
+
+// logCleanUp cleans up after a failed order and logs what was done.
+func (i acmeIssuer) logCleanUp(csr *x509.CertificateRequest, orderErr error) {
+	if skipCleanUp(orderErr) {
+		log.Infof("Not cleaning up after failed order for %s: %v", csrName(csr), orderErr)
+		return
+	}
+	summary, err := i.cleanUpAuthorizations(csr, orderErr)
+	if err != nil {
+		log.Warningf("Cleaning up after failed order for %s: %s before error: %v", csrName(csr), summary, err)
+		return
+	}
+	log.Infof("Cleaned up after failed order for %s: %s", csrName(csr), summary)
+}
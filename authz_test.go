@@ -0,0 +1,137 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/acme"
+)
+
+// fakeCA answers just enough of RFC 8555 to report the status of
+// authorizations and to deactivate them. It has no newOrder, which cleaning
+// up must not call.
+type fakeCA struct {
+	mu     sync.Mutex
+	url    string
+	authzs map[string]string
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.url + "/nonce",
+			"newAccount": ca.url + "/account",
+		})
+	case r.URL.Path == "/nonce":
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		id := strings.TrimPrefix(r.URL.Path, "/authz/")
+		if _, ok := ca.authzs[id]; !ok {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(acme.Problem{Type: "urn:ietf:params:acme:error:malformed", Status: http.StatusNotFound})
+			return
+		}
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &jws)
+		if jws.Payload != "" {
+			ca.authzs[id] = acme.StatusDeactivated
+		}
+		json.NewEncoder(w).Encode(acme.Authorization{Status: ca.authzs[id]})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDeactivateAuthorizations(t *testing.T) {
+	ca := &fakeCA{authzs: map[string]string{
+		"pending": acme.StatusPending,
+		"valid":   acme.StatusValid,
+		"invalid": acme.StatusInvalid,
+	}}
+	server := httptest.NewServer(ca)
+	defer server.Close()
+	ca.url = server.URL
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := acme.Account{PrivateKey: key, Location: server.URL + "/account/1"}
+	client := &acme.Client{Directory: server.URL + "/directory"}
+	var urls []string
+	for id := range ca.authzs {
+		urls = append(urls, server.URL+"/authz/"+id)
+	}
+	deactivated := make(map[string]int)
+	if err := deactivateAuthorizations(context.Background(), client, account, urls, deactivated); err != nil {
+		t.Fatal(err)
+	}
+	if deactivated[acme.StatusPending] != 1 || deactivated[acme.StatusValid] != 1 {
+		t.Errorf("Error: expected one pending and one valid authorization deactivated but got %v", deactivated)
+	}
+	for id, status := range map[string]string{"pending": acme.StatusDeactivated, "valid": acme.StatusDeactivated, "invalid": acme.StatusInvalid} {
+		if ca.authzs[id] != status {
+			t.Errorf("Error: expected %s authorization to be %s but got %s", id, status, ca.authzs[id])
+		}
+	}
+}
+
+func TestSkipCleanUp(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		skip bool
+	}{
+		{"Rate limited", fmt.Errorf("creating new order: %w", acme.Problem{Type: acme.ProblemTypeRateLimited}), true},
+		{"Network error", fmt.Errorf("solving challenges: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), true},
+		{"Failed validation", acme.Problem{Type: acme.ProblemTypeUnauthorized, Resource: acme.Authorization{Location: "https://ca.example/authz/1"}}, false},
+		{"Other error", errors.New("finalizing order"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if skip := skipCleanUp(test.err); skip != test.skip {
+				t.Errorf("Error: expected skip %v but got %v", test.skip, skip)
+			}
+		})
+	}
+}
+
+func TestProviderClearChallenge(t *testing.T) {
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	ctx := context.Background()
+	records := []libdns.Record{{Type: "TXT", Value: "a"}, {Type: "TXT", Value: "b"}}
+	if _, err := provider.AppendRecords(ctx, "_acme-challenge.test.domain.", records); err != nil {
+		t.Fatal(err)
+	}
+	if removed := provider.clearChallenge(ctx, "*.Test.Domain"); removed != 2 {
+		t.Errorf("Error: expected 2 records removed but got %d", removed)
+	}
+	if records, _ := provider.GetRecords(ctx, "_acme-challenge.test.domain."); len(records) != 0 {
+		t.Errorf("Error: expected no records left but got %v", records)
+	}
+	if removed := provider.clearChallenge(ctx, "other.domain"); removed != 0 {
+		t.Errorf("Error: expected nothing removed but got %d", removed)
+	}
+}
@@ -0,0 +1,124 @@
+package acme
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+)
+
+// caaIdentifiers maps the hosts of known ACME directories to the issuer
+// domain their CA checks CAA records for.
+var caaIdentifiers = map[string]string{
+	"api.letsencrypt.org": "letsencrypt.org",
+	"acme.zerossl.com":    "sectigo.com",
+	"api.pki.goog":        "pki.goog",
+	"api.buypass.com":     "buypass.com",
+	"acme.ssl.com":        "ssl.com",
+}
+
+// caaIdentifier returns the CAA issuer domain of the CA serving the ACME
+// directory, if it is known.
+func caaIdentifier(directory string) (string, bool) {
+	u, err := url.Parse(directory)
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	for suffix, identifier := range caaIdentifiers {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return identifier, true
+		}
+	}
+	return "", false
+}
+
+// CAAPolicy holds the CAA records served at the zone apex. In auto mode it
+// generates issue and issuewild records for the configured CA, limited to
+// the challenges configured (RFC 8657 validationmethods) and, once the ACME
+// account is registered, to that account (RFC 8657 accounturi).
+type CAAPolicy struct {
+	Issue     []string
+	IssueWild []string
+	Iodef     []string
+	Auto      bool
+
+	mu                sync.RWMutex
+	identifier        string
+	validationMethods []string
+	accountURI        string
+}
+
+// configure sets up auto mode for the CA and challenges of template.
+func (p *CAAPolicy) configure(template certmagic.ACMEManager) bool {
+	identifier, ok := caaIdentifier(template.CA)
+	methods := []string{"dns-01"}
+	if !template.DisableHTTPChallenge {
+		methods = append(methods, "http-01")
+	}
+	if !template.DisableTLSALPNChallenge {
+		methods = append(methods, "tls-alpn-01")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.identifier, p.validationMethods = identifier, methods
+	return ok
+}
+
+// bindAccount adds the accounturi parameter to the records generated in
+// auto mode.
+func (p *CAAPolicy) bindAccount(uri string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accountURI = uri
+}
+
+// autoValue returns the value of the records generated in auto mode, or ""
+// when the CA is unknown.
+func (p *CAAPolicy) autoValue() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.Auto || p.identifier == "" {
+		return ""
+	}
+	value := p.identifier
+	if p.accountURI != "" {
+		value += "; accounturi=" + p.accountURI
+	}
+	if len(p.validationMethods) > 0 {
+		value += "; validationmethods=" + strings.Join(p.validationMethods, ",")
+	}
+	return value
+}
+
+// records returns the CAA records for name.
+func (p *CAAPolicy) records(name string, class uint16) []dns.RR {
+	if p == nil {
+		return nil
+	}
+	var rrs []dns.RR
+	add := func(tag, value string) {
+		rr := new(dns.CAA)
+		rr.Tag = tag
+		rr.Value = value
+		rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCAA, Class: class}
+		rrs = append(rrs, rr)
+	}
+	issue, issueWild := p.Issue, p.IssueWild
+	if value := p.autoValue(); value != "" {
+		issue = append([]string{value}, issue...)
+		issueWild = append([]string{value}, issueWild...)
+	}
+	for _, value := range issue {
+		add("issue", value)
+	}
+	for _, value := range issueWild {
+		add("issuewild", value)
+	}
+	for _, value := range p.Iodef {
+		add("iodef", value)
+	}
+	return rrs
+}
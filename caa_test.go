@@ -0,0 +1,86 @@
+package acme
+
+import (
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+)
+
+func TestCAAIdentifier(t *testing.T) {
+	tests := []struct {
+		directory  string
+		identifier string
+	}{
+		{certmagic.LetsEncryptProductionCA, "letsencrypt.org"},
+		{certmagic.LetsEncryptStagingCA, "letsencrypt.org"},
+		{"https://acme.zerossl.com/v2/DV90", "sectigo.com"},
+		{"https://dv.acme-v02.api.pki.goog/directory", "pki.goog"},
+		{"https://acme.example.com/directory", ""},
+		{"https://api.letsencrypt.org.example.com/directory", ""},
+	}
+	for _, test := range tests {
+		if identifier, _ := caaIdentifier(test.directory); identifier != test.identifier {
+			t.Errorf("Error: expected CAA identifier %q for %s but got %q", test.identifier, test.directory, identifier)
+		}
+	}
+}
+
+func TestCAAPolicyRecords(t *testing.T) {
+	caaValues := func(policy *CAAPolicy) []string {
+		var values []string
+		for _, rr := range policy.records("test.domain.", dns.ClassINET) {
+			caa := rr.(*dns.CAA)
+			values = append(values, caa.Tag+" "+caa.Value)
+		}
+		return values
+	}
+	equal := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	auto := &CAAPolicy{Auto: true, Iodef: []string{"mailto:security@test.domain"}}
+	auto.configure(certmagic.ACMEManager{CA: certmagic.LetsEncryptProductionCA, DisableTLSALPNChallenge: true})
+	expected := []string{
+		"issue letsencrypt.org; validationmethods=dns-01,http-01",
+		"issuewild letsencrypt.org; validationmethods=dns-01,http-01",
+		"iodef mailto:security@test.domain",
+	}
+	if values := caaValues(auto); !equal(values, expected) {
+		t.Errorf("Error: expected %q but got %q", expected, values)
+	}
+	auto.bindAccount("https://acme-v02.api.letsencrypt.org/acme/acct/42")
+	expected = []string{
+		"issue letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/42; validationmethods=dns-01,http-01",
+		"issuewild letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/42; validationmethods=dns-01,http-01",
+		"iodef mailto:security@test.domain",
+	}
+	if values := caaValues(auto); !equal(values, expected) {
+		t.Errorf("Error: expected %q but got %q", expected, values)
+	}
+
+	unknown := &CAAPolicy{Auto: true}
+	if unknown.configure(certmagic.ACMEManager{CA: "https://acme.example.com/directory"}) {
+		t.Error("Error: expected the CA to be unknown")
+	}
+	if values := caaValues(unknown); len(values) != 0 {
+		t.Errorf("Error: expected no records for an unknown CA but got %q", values)
+	}
+
+	explicit := &CAAPolicy{Issue: []string{"pki.goog"}, IssueWild: []string{";"}}
+	expected = []string{"issue pki.goog", "issuewild ;"}
+	if values := caaValues(explicit); !equal(values, expected) {
+		t.Errorf("Error: expected %q but got %q", expected, values)
+	}
+	if values := caaValues(nil); len(values) != 0 {
+		t.Errorf("Error: expected no records without a policy but got %q", values)
+	}
+}
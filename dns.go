@@ -20,18 +20,35 @@ func getAuthoritativeNameServers(zone string) ([]string, error) {
 	return nameservers, nil
 }
 
-func getExternalIpAddress(zone string) (string, error) {
+// getExternalIpAddresses returns the IPv4 and IPv6 addresses of zone,
+// looked up separately so that a missing AAAA record does not hide the A
+// record or the other way round.
+func getExternalIpAddresses(zone string) ([]net.IP, error) {
 	resolvers := recursiveNameservers(nil)
-	r, err := dnsQuery(zone, dns.TypeA, resolvers, true)
-	if err != nil {
-		return "", fmt.Errorf("dns query for zone %v with resolvers %+v error: %+v", zone, resolvers, err)
+	var addresses []net.IP
+	var errs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, err := dnsQuery(zone, qtype, resolvers, true)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("dns query %s for zone %v with resolvers %+v error: %+v", dns.TypeToString[qtype], zone, resolvers, err))
+			continue
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addresses = append(addresses, rr.A.To4())
+			case *dns.AAAA:
+				addresses = append(addresses, rr.AAAA)
+			}
+		}
 	}
-	for _, rr := range r.Answer {
-		if a, ok := rr.(*dns.A); ok {
-			return a.A.String(), nil
+	if len(addresses) == 0 {
+		if len(errs) > 0 {
+			return nil, errors.New(strings.Join(errs, "; "))
 		}
+		return nil, fmt.Errorf("no A or AAAA record found for zone %s", zone)
 	}
-	return "", fmt.Errorf("no A record found for zone %s", zone)
+	return addresses, nil
 }
 
 /*
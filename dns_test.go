@@ -0,0 +1,70 @@
+package acme
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetExternalIpAddresses(t *testing.T) {
+	records := map[string][]string{
+		"v4.test.":   {"v4.test. 300 IN A 203.0.113.5"},
+		"v6.test.":   {"v6.test. 300 IN AAAA 2001:db8::5"},
+		"dual.test.": {"dual.test. 300 IN A 203.0.113.5", "dual.test. 300 IN AAAA 2001:db8::5"},
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, record := range records[r.Question[0].Name] {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Error(err)
+			}
+			if rr.Header().Rrtype == r.Question[0].Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	defaults := defaultNameservers
+	defaultNameservers = []string{pc.LocalAddr().String()}
+	defer func() { defaultNameservers = defaults }()
+
+	tests := []struct {
+		name      string
+		zone      string
+		addresses []string
+		shouldErr bool
+	}{
+		{"IPv4 only", "v4.test.", []string{"203.0.113.5"}, false},
+		{"IPv6 only", "v6.test.", []string{"2001:db8::5"}, false},
+		{"Dual stack", "dual.test.", []string{"203.0.113.5", "2001:db8::5"}, false},
+		{"No addresses", "none.test.", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addresses, err := getExternalIpAddresses(test.zone)
+			if (err != nil) != test.shouldErr {
+				t.Fatalf("Error: getExternalIpAddresses(%s) error = %v, shouldErr %v", test.zone, err, test.shouldErr)
+			}
+			if len(addresses) != len(test.addresses) {
+				t.Fatalf("Error: expected %v but got %v", test.addresses, addresses)
+			}
+			for i, address := range addresses {
+				if !address.Equal(net.ParseIP(test.addresses[i])) {
+					t.Errorf("Error: expected %v but got %v", test.addresses, addresses)
+				}
+			}
+			if len(addresses) > 0 && addresses[0].To4() != nil && len(addresses[0]) != net.IPv4len {
+				t.Errorf("Error: expected IPv4 addresses in their 4-byte form but got %v", addresses[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base32"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// Signatures are made for every answer, so they are valid from shortly
+// before signing to allow for clock skew, and for a week after.
+const (
+	signatureInception  = time.Hour
+	signatureExpiration = 7 * 24 * time.Hour
+)
+
+// ZoneSigner signs the answers of the zone online. The KSK signs the DNSKEY
+// set and the ZSK every other RRset. The keys are read from BIND key files
+// when KSKFile and ZSKFile are set, and otherwise generated (ECDSA P-256)
+// and kept in certmagic storage, so that replicas sharing it sign with the
+// same keys. Negative answers are proven with NSEC3 records without salt or
+// extra iterations (RFC 9276), generated to cover only the name asked for
+// so that the zone cannot be walked.
+type ZoneSigner struct {
+	Zone    string
+	KSKFile string
+	ZSKFile string
+	Storage certmagic.Storage
+
+	mu  sync.Mutex
+	ksk *signingKey
+	zsk *signingKey
+}
+
+type signingKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func dnssecKey(zone, name string) string {
+	return path.Join(storagePrefix, "dnssec", strings.TrimSuffix(zone, "."), name)
+}
+
+// load reads the keys, generating them when they are neither configured nor
+// stored. It logs the DS record to publish in the parent zone.
+func (z *ZoneSigner) load(ctx context.Context) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var err error
+	if z.KSKFile != "" {
+		z.ksk, err = readKeyFiles(z.KSKFile, z.Zone)
+		if err != nil {
+			return err
+		}
+		z.zsk, err = readKeyFiles(z.ZSKFile, z.Zone)
+		if err != nil {
+			return err
+		}
+	} else {
+		lockKey := dnssecKey(z.Zone, "lock")
+		if err := z.Storage.Lock(ctx, lockKey); err != nil {
+			return err
+		}
+		defer z.Storage.Unlock(lockKey)
+		z.ksk, err = z.loadOrCreate("ksk", dns.ZONE|dns.SEP)
+		if err != nil {
+			return err
+		}
+		z.zsk, err = z.loadOrCreate("zsk", dns.ZONE)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Signing %s with KSK %d and ZSK %d, publish DS %s in its parent zone", z.Zone, z.ksk.dnskey.KeyTag(), z.zsk.dnskey.KeyTag(), z.ksk.dnskey.ToDS(dns.SHA256))
+	return nil
+}
+
+// readKeyFiles reads the key pair of a BIND key file, given as the path
+// with or without the .key or .private extension.
+func readKeyFiles(file, zone string) (*signingKey, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(file, ".key"), ".private")
+	public, err := ioutil.ReadFile(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	private, err := ioutil.ReadFile(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	return parseKey(public, private, base, zone)
+}
+
+func parseKey(public, private []byte, file, zone string) (*signingKey, error) {
+	rr, err := dns.ReadRR(bytes.NewReader(public), file+".key")
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key holds no DNSKEY record", file)
+	}
+	if !strings.EqualFold(dnskey.Hdr.Name, zone) {
+		return nil, fmt.Errorf("%s.key is a key of %s, not of %s", file, dnskey.Hdr.Name, zone)
+	}
+	if dnskey.Flags&dns.ZONE == 0 {
+		return nil, fmt.Errorf("%s.key is not a zone key", file)
+	}
+	key, err := dnskey.ReadPrivateKey(bytes.NewReader(private), file+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s.private cannot sign", file)
+	}
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// loadOrCreate reads a key from storage, creating and storing it when it is
+// missing. The caller must hold the storage lock.
+func (z *ZoneSigner) loadOrCreate(name string, flags uint16) (*signingKey, error) {
+	public, err := z.Storage.Load(dnssecKey(z.Zone, name+".key"))
+	if err == nil {
+		private, err := z.Storage.Load(dnssecKey(z.Zone, name+".private"))
+		if err != nil {
+			return nil, err
+		}
+		return parseKey(public, private, name, z.Zone)
+	}
+	if _, ok := err.(certmagic.ErrNotExist); !ok {
+		return nil, err
+	}
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: z.Zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: defaultApexTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	key, err := dnskey.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	if err := z.Storage.Store(dnssecKey(z.Zone, name+".private"), []byte(dnskey.PrivateKeyString(key))); err != nil {
+		return nil, err
+	}
+	if err := z.Storage.Store(dnssecKey(z.Zone, name+".key"), []byte(dnskey.String()+"\n")); err != nil {
+		return nil, err
+	}
+	log.Infof("Generated DNSSEC %s %d for %s", strings.ToUpper(name), dnskey.KeyTag(), z.Zone)
+	return &signingKey{dnskey: dnskey, signer: key.(crypto.Signer)}, nil
+}
+
+func (z *ZoneSigner) keys() (ksk, zsk *signingKey) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.ksk, z.zsk
+}
+
+// dnskeys returns the DNSKEY set of the zone.
+func (z *ZoneSigner) dnskeys(class uint16) []dns.RR {
+	if z == nil {
+		return nil
+	}
+	var rrs []dns.RR
+	ksk, zsk := z.keys()
+	for _, key := range []*signingKey{ksk, zsk} {
+		rr := dns.Copy(key.dnskey)
+		rr.Header().Name, rr.Header().Class = z.Zone, class
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// nsec3param returns the NSEC3 parameters of the zone.
+func (z *ZoneSigner) nsec3param(class uint16) []dns.RR {
+	if z == nil {
+		return nil
+	}
+	return []dns.RR{&dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: z.Zone, Rrtype: dns.TypeNSEC3PARAM, Class: class},
+		Hash: dns.SHA1,
+	}}
+}
+
+// match returns the NSEC3 record of name, listing its types.
+func (z *ZoneSigner) match(name string, types []uint16, class uint16, ttl uint32) dns.RR {
+	hash := nsec3Hash(name)
+	return z.nsec3(hash, stepHash(hash, 1), types, class, ttl)
+}
+
+// cover returns an NSEC3 record covering only the hash of name, proving
+// that name does not exist (RFC 7129 section 5.1).
+func (z *ZoneSigner) cover(name string, class uint16, ttl uint32) dns.RR {
+	hash := nsec3Hash(name)
+	return z.nsec3(stepHash(hash, -1), stepHash(hash, 1), nil, class, ttl)
+}
+
+func (z *ZoneSigner) nsec3(hash, next []byte, types []uint16, class uint16, ttl uint32) dns.RR {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(base32.HexEncoding.EncodeToString(hash)) + "." + z.Zone, Rrtype: dns.TypeNSEC3, Class: class, Ttl: ttl},
+		Hash:       dns.SHA1,
+		HashLength: uint8(len(next)),
+		NextDomain: base32.HexEncoding.EncodeToString(next),
+		TypeBitMap: types,
+	}
+}
+
+func nsec3Hash(name string) []byte {
+	hash, _ := base32.HexEncoding.DecodeString(dns.HashName(name, dns.SHA1, 0, ""))
+	return hash
+}
+
+// stepHash returns the hash delta away from hash, wrapping around the hash
+// space.
+func stepHash(hash []byte, delta int) []byte {
+	step := append([]byte(nil), hash...)
+	for i := len(step) - 1; i >= 0; i-- {
+		if delta > 0 {
+			step[i]++
+			if step[i] != 0 {
+				break
+			}
+		} else {
+			step[i]--
+			if step[i] != 0xff {
+				break
+			}
+		}
+	}
+	return step
+}
+
+// signMsg signs the RRsets of every section of m.
+func (z *ZoneSigner) signMsg(m *dns.Msg, now time.Time) error {
+	var err error
+	if m.Answer, err = z.sign(m.Answer, now); err != nil {
+		return err
+	}
+	if m.Ns, err = z.sign(m.Ns, now); err != nil {
+		return err
+	}
+	m.Extra, err = z.sign(m.Extra, now)
+	return err
+}
+
+// sign returns rrs grouped into RRsets, each followed by its signature.
+func (z *ZoneSigner) sign(rrs []dns.RR, now time.Time) ([]dns.RR, error) {
+	var order []string
+	sets := make(map[string][]dns.RR)
+	var others []dns.RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT || h.Rrtype == dns.TypeRRSIG {
+			others = append(others, rr)
+			continue
+		}
+		key := fmt.Sprintf("%s/%d/%d", strings.ToLower(h.Name), h.Rrtype, h.Class)
+		if _, ok := sets[key]; !ok {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+	ksk, zsk := z.keys()
+	var signed []dns.RR
+	for _, key := range order {
+		rrset := sets[key]
+		k := zsk
+		if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+			k = ksk
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.dnskey.Algorithm,
+			KeyTag:     k.dnskey.KeyTag(),
+			SignerName: z.Zone,
+			Inception:  uint32(now.Add(-signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureExpiration).Unix()),
+		}
+		if err := sig.Sign(k.signer, rrset); err != nil {
+			return nil, err
+		}
+		signed = append(signed, rrset...)
+		signed = append(signed, sig)
+	}
+	return append(signed, others...), nil
+}
@@ -0,0 +1,131 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/miekg/dns"
+)
+
+func TestZoneSignerStorage(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+	signer := &ZoneSigner{Zone: "test.domain.", Storage: storage}
+	if err := signer.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if signer.ksk.dnskey.Flags != dns.ZONE|dns.SEP || signer.zsk.dnskey.Flags != dns.ZONE {
+		t.Errorf("Error: expected a KSK and a ZSK but got flags %d and %d", signer.ksk.dnskey.Flags, signer.zsk.dnskey.Flags)
+	}
+	// a replica sharing the storage signs with the same keys
+	replica := &ZoneSigner{Zone: "test.domain.", Storage: storage}
+	if err := replica.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if replica.ksk.dnskey.KeyTag() != signer.ksk.dnskey.KeyTag() || replica.zsk.dnskey.KeyTag() != signer.zsk.dnskey.KeyTag() {
+		t.Errorf("Error: expected the stored keys to be reused")
+	}
+
+	txt, _ := dns.NewRR("_acme-challenge.test.domain. 30 IN TXT token")
+	keys := signer.dnskeys(dns.ClassINET)
+	signed, err := replica.sign(append([]dns.RR{txt}, keys...), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != 5 {
+		t.Fatalf("Error: expected two RRsets with their signatures but got %v", signed)
+	}
+	for _, test := range []struct {
+		rrset []dns.RR
+		sig   dns.RR
+		key   *dns.DNSKEY
+	}{
+		{signed[:1], signed[1], signer.zsk.dnskey},
+		{signed[2:4], signed[4], signer.ksk.dnskey},
+	} {
+		sig := test.sig.(*dns.RRSIG)
+		if err := sig.Verify(test.key, test.rrset); err != nil {
+			t.Errorf("Error: signature of %v does not verify: %v", test.rrset, err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("Error: expected %v to be valid now", sig)
+		}
+	}
+}
+
+func TestZoneSignerKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, zone string, flags uint16) string {
+		dnskey := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     flags,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		key, err := dnskey.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(base+".key", []byte("; a key file\n"+dnskey.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(base+".private", []byte(dnskey.PrivateKeyString(key)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return base
+	}
+	ksk := write("Ktest.domain.+013+00001", "test.domain.", dns.ZONE|dns.SEP)
+	zsk := write("Ktest.domain.+013+00002", "test.domain.", dns.ZONE)
+	other := write("Kother.domain.+013+00003", "other.domain.", dns.ZONE)
+	nonZone := write("Ktest.domain.+013+00004", "test.domain.", 0)
+
+	tests := []struct {
+		name    string
+		ksk     string
+		zsk     string
+		wantErr bool
+	}{
+		{"Base names", ksk, zsk, false},
+		{"With extensions", ksk + ".key", zsk + ".private", false},
+		{"Missing file", ksk, filepath.Join(dir, "missing"), true},
+		{"Key of another zone", ksk, other, true},
+		{"Not a zone key", ksk, nonZone, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer := &ZoneSigner{Zone: "test.domain.", KSKFile: test.ksk, ZSKFile: test.zsk}
+			err := signer.load(context.Background())
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Error: expected error %v but got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNSEC3WhiteLies(t *testing.T) {
+	signer := &ZoneSigner{Zone: "test.domain."}
+	cover := signer.cover("missing.test.domain.", dns.ClassINET, 60).(*dns.NSEC3)
+	if !cover.Cover("missing.test.domain.") || cover.Match("missing.test.domain.") {
+		t.Errorf("Error: expected %v to cover missing.test.domain.", cover)
+	}
+	if cover.Cover("test.domain.") || cover.Cover("other.test.domain.") {
+		t.Errorf("Error: expected %v to cover only missing.test.domain.", cover)
+	}
+	match := signer.match("test.domain.", []uint16{dns.TypeSOA}, dns.ClassINET, 60).(*dns.NSEC3)
+	if !match.Match("test.domain.") {
+		t.Errorf("Error: expected %v to match test.domain.", match)
+	}
+
+	if got := stepHash([]byte{0x00, 0xff}, 1); !bytes.Equal(got, []byte{0x01, 0x00}) {
+		t.Errorf("Error: expected the increment to carry but got %x", got)
+	}
+	if got := stepHash([]byte{0x00, 0x00}, -1); !bytes.Equal(got, []byte{0xff, 0xff}) {
+		t.Errorf("Error: expected the decrement to wrap around but got %x", got)
+	}
+}
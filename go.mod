@@ -8,5 +8,8 @@ require (
 	github.com/coredns/coredns v1.8.4
 	github.com/google/uuid v1.2.0
 	github.com/libdns/libdns v0.2.1
+	github.com/mholt/acmez v0.1.3
 	github.com/miekg/dns v1.1.42
+	github.com/prometheus/client_golang v1.10.0
+	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
 )
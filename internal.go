@@ -0,0 +1,286 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	internalRootLifetime         = 10 * 365 * 24 * time.Hour
+	internalIntermediateLifetime = 365 * 24 * time.Hour
+	defaultInternalLeafLifetime  = 24 * time.Hour
+)
+
+// InternalCA issues certificates from a root and intermediate generated
+// locally and kept in certmagic storage, for deployments that cannot reach
+// a public ACME CA. It implements certmagic's Issuer and Revoker, so its
+// certificates are renewed and hot-swapped like ACME-issued ones.
+type InternalCA struct {
+	Storage      certmagic.Storage
+	LeafLifetime time.Duration
+	// PermittedDNSDomains and PermittedIPRanges name-constrain the root, so
+	// that clients trusting it only trust it for the zone and the configured
+	// IP addresses. The root is unconstrained when both are empty.
+	PermittedDNSDomains []string
+	PermittedIPRanges   []*net.IPNet
+
+	mu           sync.Mutex
+	root         *x509.Certificate
+	rootKey      crypto.Signer
+	intermediate *x509.Certificate
+	interKey     crypto.Signer
+}
+
+func internalCAKey(name string) string {
+	return path.Join(storagePrefix, "internal", name)
+}
+
+func (ca *InternalCA) IssuerKey() string { return "internal" }
+
+// RootPEM returns the PEM encoded root certificate clients need to trust.
+func (ca *InternalCA) RootPEM(ctx context.Context) ([]byte, error) {
+	if err := ca.load(ctx); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw}), nil
+}
+
+func (ca *InternalCA) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR: %v", err)
+	}
+	if err := ca.load(ctx); err != nil {
+		return nil, err
+	}
+	if err := ca.checkNames(csr); err != nil {
+		return nil, err
+	}
+	ca.mu.Lock()
+	intermediate, interKey := ca.intermediate, ca.interKey
+	ca.mu.Unlock()
+
+	lifetime := ca.LeafLifetime
+	if lifetime == 0 {
+		lifetime = defaultInternalLeafLifetime
+	}
+	notBefore := time.Now().Add(-time.Minute)
+	notAfter := notBefore.Add(lifetime)
+	if notAfter.After(intermediate.NotAfter) {
+		notAfter = intermediate.NotAfter
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csrName(csr)},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, intermediate, csr.PublicKey, interKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate for %s: %v", csrName(csr), err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+	return &certmagic.IssuedCertificate{Certificate: chain}, nil
+}
+
+// Revoke lets certmagic drop the certificate from storage. The internal CA
+// publishes no revocation information, and its leaves are short-lived.
+func (ca *InternalCA) Revoke(ctx context.Context, cert certmagic.CertificateResource, reason int) error {
+	return nil
+}
+
+// load reads the root and intermediate from storage, creating them when
+// missing and rotating the intermediate before it expires. The storage lock
+// keeps replicas sharing storage from creating different roots.
+func (ca *InternalCA) load(ctx context.Context) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.intermediate != nil && time.Until(ca.intermediate.NotAfter) > internalIntermediateLifetime/12 {
+		return nil
+	}
+	lockKey := internalCAKey("lock")
+	if err := ca.Storage.Lock(ctx, lockKey); err != nil {
+		return err
+	}
+	defer ca.Storage.Unlock(lockKey)
+
+	root, rootKey, err := ca.loadPair("root")
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		root, rootKey, err = ca.createPair("root", pkix.Name{CommonName: "CoreDNS ACME Internal Root"}, internalRootLifetime, nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if ca.constrained() && len(root.PermittedDNSDomains) == 0 && len(root.PermittedIPRanges) == 0 {
+		// replacing the root would break every client trusting it
+		log.Warningf("The internal root in storage predates name constraints and is trusted for any name; remove it from %s to create a constrained one", internalCAKey(""))
+	}
+	intermediate, interKey, err := ca.loadPair("intermediate")
+	_, missing := err.(certmagic.ErrNotExist)
+	if err != nil && !missing {
+		return err
+	}
+	if missing || time.Until(intermediate.NotAfter) <= internalIntermediateLifetime/12 {
+		intermediate, interKey, err = ca.createPair("intermediate", pkix.Name{CommonName: "CoreDNS ACME Internal Intermediate"}, internalIntermediateLifetime, root, rootKey)
+		if err != nil {
+			return err
+		}
+	}
+	ca.root, ca.rootKey = root, rootKey
+	ca.intermediate, ca.interKey = intermediate, interKey
+	return nil
+}
+
+func (ca *InternalCA) loadPair(name string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := ca.Storage.Load(internalCAKey(name + ".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ca.Storage.Load(internalCAKey(name + ".key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("internal CA %s is not PEM encoded", name)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// hostNetwork returns the network holding only ip.
+func hostNetwork(ip net.IP) *net.IPNet {
+	bits := net.IPv6len * 8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, net.IPv4len*8
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func (ca *InternalCA) constrained() bool {
+	return len(ca.PermittedDNSDomains) > 0 || len(ca.PermittedIPRanges) > 0
+}
+
+// checkNames refuses names of csr outside the name constraints, which
+// clients would reject.
+func (ca *InternalCA) checkNames(csr *x509.CertificateRequest) error {
+	if !ca.constrained() {
+		return nil
+	}
+	for _, name := range csr.DNSNames {
+		permitted := false
+		for _, domain := range ca.PermittedDNSDomains {
+			if dns.IsSubDomain(dns.Fqdn(strings.ToLower(domain)), dns.Fqdn(strings.ToLower(strings.TrimPrefix(name, "*.")))) {
+				permitted = true
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("%s is outside the names the internal CA is constrained to: %v", name, ca.PermittedDNSDomains)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		permitted := false
+		for _, network := range ca.PermittedIPRanges {
+			if network.Contains(ip) {
+				permitted = true
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("%s is outside the addresses the internal CA is constrained to: %v", ip, ca.PermittedIPRanges)
+		}
+	}
+	return nil
+}
+
+// createPair creates and stores a CA certificate, self-signed when parent
+// is nil.
+func (ca *InternalCA) createPair(name string, subject pkix.Name, lifetime time.Duration, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        parent != nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+		if ca.constrained() {
+			template.PermittedDNSDomainsCritical = true
+			template.PermittedDNSDomains = ca.PermittedDNSDomains
+			template.PermittedIPRanges = ca.PermittedIPRanges
+			if len(ca.PermittedIPRanges) == 0 {
+				// without IP constraints any IP address would be trusted
+				_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+				_, v6, _ := net.ParseCIDR("::/0")
+				template.ExcludedIPRanges = []*net.IPNet{v4, v6}
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ca.Storage.Store(internalCAKey(name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return nil, nil, err
+	}
+	if err := ca.Storage.Store(internalCAKey(name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,140 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestInternalCAIssue(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ca := &InternalCA{
+		Storage:             storage,
+		LeafLifetime:        12 * time.Hour,
+		PermittedDNSDomains: []string{"example.com"},
+		PermittedIPRanges:   []*net.IPNet{hostNetwork(net.ParseIP("203.0.113.5"))},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames:    []string{"dns.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("203.0.113.5")},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := ca.Issue(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafBlock, rest := pem.Decode(issued.Certificate)
+	interBlock, _ := pem.Decode(rest)
+	if leafBlock == nil || interBlock == nil {
+		t.Fatalf("Error: expected leaf and intermediate in chain, got %s", issued.Certificate)
+	}
+	leaf, err := x509.ParseCertificate(leafBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := x509.ParseCertificate(interBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime != 12*time.Hour {
+		t.Errorf("Error: expected a 12h leaf but got %s", lifetime)
+	}
+
+	// a second CA on the same storage must serve the same root
+	rootPEM, err := (&InternalCA{Storage: storage}).RootPEM(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(rootPEM)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+	for _, name := range []string{"dns.example.com", "203.0.113.5"} {
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates})
+		if err != nil {
+			t.Errorf("Error: leaf does not verify for %s: %v", name, err)
+		}
+	}
+}
+
+func TestInternalCANameConstraints(t *testing.T) {
+	ca := &InternalCA{
+		Storage:             &certmagic.FileStorage{Path: t.TempDir()},
+		PermittedDNSDomains: []string{"example.com"},
+		PermittedIPRanges:   []*net.IPNet{hostNetwork(net.ParseIP("203.0.113.5"))},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		dns     []string
+		ips     []net.IP
+		wantErr bool
+	}{
+		{"Name in the zone", []string{"dns.example.com", "*.example.com"}, nil, false},
+		{"Configured address", nil, []net.IP{net.ParseIP("203.0.113.5")}, false},
+		{"Name outside the zone", []string{"dns.example.org"}, nil, true},
+		{"Other address", nil, []net.IP{net.ParseIP("203.0.113.6")}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: test.dns, IPAddresses: test.ips}, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(csrDER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ca.Issue(context.Background(), csr); (err != nil) != test.wantErr {
+				t.Fatalf("Error: expected error %v but got %v", test.wantErr, err)
+			}
+		})
+	}
+
+	// clients reject a leaf outside the constraints even when the
+	// intermediate signs it
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"dns.example.org"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.intermediate, key.Public(), ca.interKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(ca.intermediate)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "dns.example.org", Roots: roots, Intermediates: intermediates}); err == nil {
+		t.Errorf("Error: expected a leaf outside the zone not to verify")
+	}
+}
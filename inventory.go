@@ -0,0 +1,238 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// ResultSuccess is the LastResult of a renewal attempt that succeeded.
+const ResultSuccess = "success"
+
+// CertificateStatus is the inventory entry of a managed name.
+type CertificateStatus struct {
+	Name string `json:"name"`
+	// Issuer is the common name of the CA that issued the certificate.
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	KeyType   string    `json:"key_type"`
+	// LastResult is ResultSuccess or the error of the last attempt to
+	// obtain or renew the certificate.
+	LastAttempt time.Time `json:"last_attempt"`
+	LastResult  string    `json:"last_result"`
+	NextRenewal time.Time `json:"next_renewal"`
+	// Challenge is the ACME challenge type last seen solved for the name.
+	// It is empty when the CA reused an existing authorization, or the
+	// challenge was answered by certmagic's own listener.
+	Challenge string `json:"challenge"`
+}
+
+// Inventory keeps the status of every managed name in certmagic storage.
+type Inventory struct {
+	Storage certmagic.Storage
+	Renewal RenewalPolicy
+
+	mu         sync.Mutex
+	challenges map[string]string
+}
+
+func inventoryPrefix() string {
+	return path.Join(storagePrefix, "inventory")
+}
+
+func (inv *Inventory) key(name string) string {
+	return path.Join(inventoryPrefix(), certmagic.StorageKeys.Safe(name)+".json")
+}
+
+// Get returns the inventory entry for name.
+func (inv *Inventory) Get(name string) (CertificateStatus, error) {
+	return inv.load(inv.key(name))
+}
+
+func (inv *Inventory) load(key string) (CertificateStatus, error) {
+	data, err := inv.Storage.Load(key)
+	if err != nil {
+		return CertificateStatus{}, err
+	}
+	var status CertificateStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return CertificateStatus{}, fmt.Errorf("decoding inventory entry %s: %v", key, err)
+	}
+	return status, nil
+}
+
+// List returns every inventory entry, sorted by name.
+func (inv *Inventory) List() ([]CertificateStatus, error) {
+	keys, err := inv.Storage.List(inventoryPrefix(), false)
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var statuses []CertificateStatus
+	for _, key := range keys {
+		status, err := inv.load(key)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, nil
+}
+
+func (inv *Inventory) update(name string, f func(*CertificateStatus)) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	status, err := inv.Get(name)
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		status, err = CertificateStatus{Name: name}, nil
+	}
+	if err != nil {
+		return err
+	}
+	f(&status)
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return inv.Storage.Store(inv.key(name), data)
+}
+
+// recordChallenge notes the challenge type being solved for name, to be
+// recorded once its certificate is issued.
+func (inv *Inventory) recordChallenge(name, challengeType string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if inv.challenges == nil {
+		inv.challenges = make(map[string]string)
+	}
+	inv.challenges[strings.ToLower(name)] = challengeType
+}
+
+// recordAttempt records the result of an attempt to obtain or renew the
+// certificate for name.
+func (inv *Inventory) recordAttempt(name string, issued *certmagic.IssuedCertificate, attemptErr error) error {
+	var leaf *x509.Certificate
+	if attemptErr == nil {
+		block, _ := pem.Decode(issued.Certificate)
+		if block == nil {
+			return fmt.Errorf("issued certificate for %s is not PEM encoded", name)
+		}
+		var err error
+		leaf, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+	inv.mu.Lock()
+	challenge, solved := inv.challenges[strings.ToLower(name)]
+	delete(inv.challenges, strings.ToLower(name))
+	inv.mu.Unlock()
+	return inv.update(name, func(status *CertificateStatus) {
+		status.LastAttempt = time.Now()
+		if attemptErr != nil {
+			status.LastResult = attemptErr.Error()
+			return
+		}
+		status.LastResult = ResultSuccess
+		status.Challenge = ""
+		if solved {
+			status.Challenge = challenge
+		}
+		inv.setCertificate(status, leaf)
+	})
+}
+
+// recordCertificate records the certificate currently managed for name,
+// such as one loaded from storage.
+func (inv *Inventory) recordCertificate(name string, leaf *x509.Certificate) error {
+	return inv.update(name, func(status *CertificateStatus) {
+		inv.setCertificate(status, leaf)
+	})
+}
+
+func (inv *Inventory) setCertificate(status *CertificateStatus, leaf *x509.Certificate) {
+	status.Issuer = leaf.Issuer.CommonName
+	status.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+	status.NotBefore, status.NotAfter = leaf.NotBefore, leaf.NotAfter
+	status.KeyType = keyType(leaf.PublicKey)
+	status.NextRenewal = inv.Renewal.NextRenewal(leaf.NotBefore, leaf.NotAfter, time.Now())
+}
+
+func keyType(key crypto.PublicKey) string {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+// inventoryIssuer records every attempt of its issuer in the inventory.
+type inventoryIssuer struct {
+	certmagic.Issuer
+	inventory *Inventory
+}
+
+func (i inventoryIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	issued, err := i.Issuer.Issue(ctx, csr)
+	if recordErr := i.inventory.recordAttempt(csrName(csr), issued, err); recordErr != nil {
+		log.Warningf("recording %s in the inventory: %v", csrName(csr), recordErr)
+	}
+	return issued, err
+}
+
+func (i inventoryIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	if checker, ok := i.Issuer.(certmagic.PreChecker); ok {
+		return checker.PreCheck(ctx, names, interactive)
+	}
+	return nil
+}
+
+func (i inventoryIssuer) Revoke(ctx context.Context, cert certmagic.CertificateResource, reason int) error {
+	if revoker, ok := i.Issuer.(certmagic.Revoker); ok {
+		return revoker.Revoke(ctx, cert, reason)
+	}
+	return fmt.Errorf("issuer %s cannot revoke certificates", i.IssuerKey())
+}
+
+// inventorySolver notes the challenges its solver presents in the inventory.
+type inventorySolver struct {
+	acmez.Solver
+	inventory *Inventory
+}
+
+func (s inventorySolver) Present(ctx context.Context, chal acme.Challenge) error {
+	s.inventory.recordChallenge(chal.Identifier.Value, chal.Type)
+	return s.Solver.Present(ctx, chal)
+}
+
+func (s inventorySolver) Wait(ctx context.Context, chal acme.Challenge) error {
+	if waiter, ok := s.Solver.(acmez.Waiter); ok {
+		return waiter.Wait(ctx, chal)
+	}
+	return nil
+}
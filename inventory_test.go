@@ -0,0 +1,83 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+type failingIssuer struct{}
+
+func (failingIssuer) Issue(context.Context, *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	return nil, errors.New("validation failed")
+}
+
+func (failingIssuer) IssuerKey() string { return "failing" }
+
+func TestInventory(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	inventory := &Inventory{Storage: storage}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrFor := func(name string) *x509.CertificateRequest {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+	ctx := context.Background()
+	issuer := inventoryIssuer{Issuer: &InternalCA{Storage: storage, LeafLifetime: 12 * time.Hour}, inventory: inventory}
+	inventory.recordChallenge("test.domain", "dns-01")
+	if _, err := issuer.Issue(ctx, csrFor("test.domain")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (inventoryIssuer{Issuer: failingIssuer{}, inventory: inventory}).Issue(ctx, csrFor("a.test.domain")); err == nil {
+		t.Fatal("Error: expected the failing issuer to fail")
+	}
+
+	statuses, err := inventory.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].Name != "a.test.domain" || statuses[1].Name != "test.domain" {
+		t.Fatalf("Error: expected entries for a.test.domain and test.domain but got %+v", statuses)
+	}
+	failed, issued := statuses[0], statuses[1]
+	if failed.LastResult != "validation failed" || failed.LastAttempt.IsZero() || failed.Serial != "" {
+		t.Errorf("Error: expected a failed attempt without certificate but got %+v", failed)
+	}
+	if issued.LastResult != ResultSuccess || issued.Challenge != "dns-01" {
+		t.Errorf("Error: expected a successful dns-01 attempt but got %+v", issued)
+	}
+	if issued.Issuer != "CoreDNS ACME Internal Intermediate" || issued.KeyType != "ECDSA P-256" || issued.Serial == "" {
+		t.Errorf("Error: expected the internal certificate's details but got %+v", issued)
+	}
+	if lifetime := issued.NotAfter.Sub(issued.NotBefore); lifetime != 12*time.Hour {
+		t.Errorf("Error: expected a 12h certificate but got %s", lifetime)
+	}
+	if !issued.NextRenewal.After(issued.NotBefore) || !issued.NextRenewal.Before(issued.NotAfter) {
+		t.Errorf("Error: expected the next renewal within the certificate's lifetime but got %s", issued.NextRenewal)
+	}
+
+	// the challenge is only attributed to the attempt it was solved for
+	if _, err := issuer.Issue(ctx, csrFor("test.domain")); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := inventory.Get("test.domain"); err != nil || status.Challenge != "" {
+		t.Errorf("Error: expected no challenge for a renewal without one but got %+v, %v", status, err)
+	}
+}
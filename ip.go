@@ -0,0 +1,106 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// idPEACMEIdentifierV1 is the acmeValidation-v1 extension, RFC 8737 section 6.1.
+var idPEACMEIdentifierV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ipFromReverseName turns the reverse mapping name a CA sends as SNI for
+// TLS-ALPN-01 on IP identifiers (RFC 8738 section 6) back into the IP address.
+func ipFromReverseName(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// tlsALPNIPChallengeCert is acmez.TLSALPN01ChallengeCert for IP identifiers,
+// which must carry the address as an IP SAN rather than a DNS name.
+func tlsALPNIPChallengeCert(challenge acme.Challenge) (*tls.Certificate, error) {
+	ip := net.ParseIP(challenge.Identifier.Value)
+	if ip == nil {
+		return nil, fmt.Errorf("challenge identifier %s is not an IP address", challenge.Identifier.Value)
+	}
+	keyAuthSum := sha256.Sum256([]byte(challenge.KeyAuthorization))
+	keyAuthSumASN1, err := asn1.Marshal(keyAuthSum[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{ip},
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPEACMEIdentifierV1, Critical: true, Value: keyAuthSumASN1},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func splitIdentifiers(names []string) (dnsNames, ips []string) {
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			ips = append(ips, name)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	return dnsNames, ips
+}
@@ -0,0 +1,65 @@
+package acme
+
+import (
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+func TestIPFromReverseName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"203.0.113.5", "203.0.113.5"},
+		{"2001:db8::53", "2001:db8::53"},
+		{"::1", "::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reverse, err := dns.ReverseAddr(test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ip := ipFromReverseName(reverse)
+			if !ip.Equal(net.ParseIP(test.expected)) {
+				t.Errorf("Error: expected %s from %s but got %s", test.expected, reverse, ip)
+			}
+		})
+	}
+	for _, name := range []string{"example.com", "113.0.203.in-addr.arpa.", "x.5.113.0.203.in-addr.arpa."} {
+		if ip := ipFromReverseName(name); ip != nil {
+			t.Errorf("Error: expected no IP from %s but got %s", name, ip)
+		}
+	}
+}
+
+func TestTLSALPNIPChallengeCert(t *testing.T) {
+	chal := acme.Challenge{
+		Identifier:       acme.Identifier{Type: "ip", Value: "203.0.113.5"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	cert, err := tlsALPNIPChallengeCert(chal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("203.0.113.5")) {
+		t.Errorf("Error: expected only the IP SAN 203.0.113.5 but got %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	var found bool
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(idPEACMEIdentifierV1) {
+			found = ext.Critical
+		}
+	}
+	if !found {
+		t.Errorf("Error: critical acmeIdentifier extension missing")
+	}
+}
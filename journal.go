@@ -0,0 +1,403 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// restoredCheckInterval is how often the CA is asked about restored
+// challenges until none is pending. A pending authorization stays
+// completable for days, 7 with Let's Encrypt.
+const restoredCheckInterval = time.Hour
+
+// OrderJournal persists the state of in-flight ACME orders, the challenges
+// being solved and the DNS-01 TXT records presented for them, so that a
+// restart does not lose the records a CA may still be validating, and the
+// orders are resumed rather than placed again.
+type OrderJournal struct {
+	Storage certmagic.Storage
+	Zone    string
+
+	mu       sync.Mutex
+	restored map[string]acme.Challenge
+}
+
+type journalRecord struct {
+	// Orders are keyed by their URL.
+	Orders     map[string]journalOrder     `json:"orders,omitempty"`
+	Challenges map[string]journalChallenge `json:"challenges,omitempty"`
+	Records    []journalTXT                `json:"records,omitempty"`
+}
+
+// journalOrder is what resuming an order needs: the CA is asked for the
+// status of the order and of its authorizations.
+type journalOrder struct {
+	Identifiers    []acme.Identifier `json:"identifiers"`
+	Authorizations []string          `json:"authorizations"`
+	Finalize       string            `json:"finalize"`
+	Placed         time.Time         `json:"placed"`
+}
+
+type journalChallenge struct {
+	Challenge acme.Challenge `json:"challenge"`
+	Presented time.Time      `json:"presented"`
+}
+
+type journalTXT struct {
+	Zone   string        `json:"zone"`
+	Record libdns.Record `json:"record"`
+	Added  time.Time     `json:"added"`
+}
+
+func (j *OrderJournal) key() string {
+	return path.Join(storagePrefix, "orders", j.Zone+".json")
+}
+
+func (j *OrderJournal) update(f func(*journalRecord)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	record, err := j.load()
+	if err != nil {
+		return err
+	}
+	f(&record)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return j.Storage.Store(j.key(), data)
+}
+
+func (j *OrderJournal) load() (journalRecord, error) {
+	record := journalRecord{}
+	data, err := j.Storage.Load(j.key())
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		return record, nil
+	}
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("decoding order journal %s: %v", j.key(), err)
+	}
+	return record, nil
+}
+
+func (j *OrderJournal) addOrder(order acme.Order) error {
+	return j.update(func(record *journalRecord) {
+		if record.Orders == nil {
+			record.Orders = make(map[string]journalOrder)
+		}
+		record.Orders[order.Location] = journalOrder{
+			Identifiers:    order.Identifiers,
+			Authorizations: order.Authorizations,
+			Finalize:       order.Finalize,
+			Placed:         time.Now(),
+		}
+	})
+}
+
+func (j *OrderJournal) removeOrder(url string) error {
+	return j.update(func(record *journalRecord) {
+		delete(record.Orders, url)
+	})
+}
+
+// findOrder returns the journaled order for exactly identifiers, if any.
+func (j *OrderJournal) findOrder(identifiers []acme.Identifier) (acme.Order, bool, error) {
+	j.mu.Lock()
+	record, err := j.load()
+	j.mu.Unlock()
+	if err != nil {
+		return acme.Order{}, false, err
+	}
+	want := identifierSet(identifiers)
+	for url, order := range record.Orders {
+		if identifierSet(order.Identifiers) != want {
+			continue
+		}
+		return acme.Order{
+			Location:       url,
+			Identifiers:    order.Identifiers,
+			Authorizations: order.Authorizations,
+			Finalize:       order.Finalize,
+		}, true, nil
+	}
+	return acme.Order{}, false, nil
+}
+
+// identifierSet returns the identifiers of an order in a comparable form.
+func identifierSet(identifiers []acme.Identifier) string {
+	set := make([]string, 0, len(identifiers))
+	for _, id := range identifiers {
+		set = append(set, id.Type+":"+strings.ToLower(id.Value))
+	}
+	sort.Strings(set)
+	return strings.Join(set, ",")
+}
+
+func (j *OrderJournal) addChallenge(chal acme.Challenge) error {
+	return j.update(func(record *journalRecord) {
+		if record.Challenges == nil {
+			record.Challenges = make(map[string]journalChallenge)
+		}
+		record.Challenges[chal.URL] = journalChallenge{Challenge: chal, Presented: time.Now()}
+	})
+}
+
+func (j *OrderJournal) removeChallenge(chal acme.Challenge) error {
+	return j.update(func(record *journalRecord) {
+		delete(record.Challenges, chal.URL)
+	})
+}
+
+func (j *OrderJournal) addRecords(zone string, recs []libdns.Record) error {
+	return j.update(func(record *journalRecord) {
+		for _, rec := range recs {
+			record.Records = append(record.Records, journalTXT{Zone: zone, Record: rec, Added: time.Now()})
+		}
+	})
+}
+
+func (j *OrderJournal) deleteRecords(zone string, recs []libdns.Record) error {
+	return j.update(func(record *journalRecord) {
+		kept := record.Records[:0]
+		for _, txt := range record.Records {
+			deleted := false
+			for _, rec := range recs {
+				deleted = deleted || (txt.Zone == zone && compareRecords(txt.Record, rec))
+			}
+			if !deleted {
+				kept = append(kept, txt)
+			}
+		}
+		record.Records = kept
+	})
+}
+
+// Restore puts the TXT records of the journaled challenges back into the
+// provider, since the CA may still validate them, and drops records whose
+// challenge was never journaled or already cleaned up. It returns the
+// challenges that were pending when the process stopped; CheckRestored
+// removes them once the CA is done with them.
+func (j *OrderJournal) Restore(p *Provider) ([]acme.Challenge, error) {
+	var pending []acme.Challenge
+	var restored []journalTXT
+	err := j.update(func(record *journalRecord) {
+		digests := make(map[string]bool)
+		for _, chal := range record.Challenges {
+			pending = append(pending, chal.Challenge)
+			digests[chal.Challenge.DNS01KeyAuthorization()] = true
+		}
+		kept := record.Records[:0]
+		for _, txt := range record.Records {
+			if digests[txt.Record.Value] {
+				kept = append(kept, txt)
+			}
+		}
+		record.Records = kept
+		restored = append([]journalTXT(nil), kept...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	j.restored = make(map[string]acme.Challenge)
+	for _, chal := range pending {
+		j.restored[chal.URL] = chal
+	}
+	j.mu.Unlock()
+	p.Lock()
+	defer p.Unlock()
+	var added []challengeRecord
+	for _, txt := range restored {
+		store := p.getZoneRecords(context.Background(), txt.Zone)
+		if store == nil {
+			store = new(RecordStore)
+			p.recordMap[txt.Zone] = store
+		}
+		store.entries = append(store.entries, txt.Record)
+		added = append(added, challengeRecord{Zone: txt.Zone, Value: txt.Record.Value})
+	}
+	if len(restored) > 0 {
+		p.changed(nil, added)
+	}
+	return pending, nil
+}
+
+// CheckRestored asks the CA for the status of each journaled order and
+// restored challenge. The orders it can no longer complete are removed
+// from the journal, and so are the challenges it validated, failed or no
+// longer knows, with their TXT records, whether or not an order was
+// resumed with them. It returns the number of orders and challenges still
+// pending.
+func (j *OrderJournal) CheckRestored(ctx context.Context, client *acme.Client, account acme.Account, p *Provider) (int, error) {
+	j.mu.Lock()
+	var restored []acme.Challenge
+	for _, chal := range j.restored {
+		restored = append(restored, chal)
+	}
+	record, err := j.load()
+	j.mu.Unlock()
+	if err != nil {
+		return len(restored), err
+	}
+	pending := 0
+	for url := range record.Orders {
+		status, err := orderStatus(ctx, client, account, url)
+		if err != nil {
+			return len(record.Orders) + len(restored), err
+		}
+		if resumable(status) {
+			pending++
+			continue
+		}
+		if err := j.removeOrder(url); err != nil {
+			return len(record.Orders) + len(restored), err
+		}
+	}
+	for _, chal := range restored {
+		done, err := challengeDone(ctx, client, account, chal.URL)
+		if err != nil {
+			return len(restored), err
+		}
+		if !done {
+			pending++
+			continue
+		}
+		if err := j.forget(ctx, chal, p); err != nil {
+			return len(restored), err
+		}
+	}
+	return pending, nil
+}
+
+// orderStatus returns the status of the order at url. acmez has no call to
+// fetch an order, but its POST-as-GET returns an object whose status
+// decodes like an authorization's. An order the CA no longer knows is
+// reported invalid.
+func orderStatus(ctx context.Context, client *acme.Client, account acme.Account, url string) (string, error) {
+	order, err := client.GetAuthorization(ctx, account, url)
+	var problem acme.Problem
+	if errors.As(err, &problem) && problem.Status >= 400 && problem.Status < 500 {
+		return acme.StatusInvalid, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return order.Status, nil
+}
+
+// resumable reports whether an order with status can still be completed
+// by finalizing it with a new CSR. A processing or valid order was
+// finalized with a key that did not outlive the process that made it.
+func resumable(status string) bool {
+	return status == acme.StatusPending || status == acme.StatusReady
+}
+
+// challengeDone reports whether the CA will no longer validate the
+// challenge at url. The order and authorization a challenge belongs to are
+// not handed to solvers, so the challenge itself is asked for: its POST-as-
+// GET returns an object whose status decodes like an authorization's.
+func challengeDone(ctx context.Context, client *acme.Client, account acme.Account, url string) (bool, error) {
+	chal, err := client.GetAuthorization(ctx, account, url)
+	var problem acme.Problem
+	if errors.As(err, &problem) && problem.Status >= 400 && problem.Status < 500 {
+		// the authorization expired or was deactivated
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return chal.Status != acme.StatusPending && chal.Status != acme.StatusProcessing, nil
+}
+
+// forgetIdentifiers removes the journaled challenges for the identifier
+// values, and their TXT records.
+func (j *OrderJournal) forgetIdentifiers(ctx context.Context, values map[string]bool, p *Provider) error {
+	j.mu.Lock()
+	record, err := j.load()
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, chal := range record.Challenges {
+		if !values[strings.ToLower(chal.Challenge.Identifier.Value)] {
+			continue
+		}
+		if err := j.forget(ctx, chal.Challenge, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forget removes a journaled challenge and its TXT records.
+func (j *OrderJournal) forget(ctx context.Context, chal acme.Challenge, p *Provider) error {
+	var records []journalTXT
+	digest := chal.DNS01KeyAuthorization()
+	err := j.update(func(record *journalRecord) {
+		delete(record.Challenges, chal.URL)
+		for _, txt := range record.Records {
+			if txt.Record.Value == digest {
+				records = append(records, txt)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, txt := range records {
+		if _, err := p.DeleteRecords(ctx, txt.Zone, []libdns.Record{txt.Record}); err != nil {
+			return err
+		}
+	}
+	j.mu.Lock()
+	delete(j.restored, chal.URL)
+	j.mu.Unlock()
+	return nil
+}
+
+// journalingSolver records the challenges its solver presents in the
+// journal until they are cleaned up.
+type journalingSolver struct {
+	acmez.Solver
+	journal *OrderJournal
+}
+
+func (s journalingSolver) Present(ctx context.Context, chal acme.Challenge) error {
+	if err := s.Solver.Present(ctx, chal); err != nil {
+		return err
+	}
+	if err := s.journal.addChallenge(chal); err != nil {
+		log.Warningf("journaling challenge %s: %v", chal.URL, err)
+	}
+	return nil
+}
+
+func (s journalingSolver) Wait(ctx context.Context, chal acme.Challenge) error {
+	if waiter, ok := s.Solver.(acmez.Waiter); ok {
+		return waiter.Wait(ctx, chal)
+	}
+	return nil
+}
+
+func (s journalingSolver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	if err := s.journal.removeChallenge(chal); err != nil {
+		log.Warningf("journaling challenge %s: %v", chal.URL, err)
+	}
+	return s.Solver.CleanUp(ctx, chal)
+}
@@ -0,0 +1,136 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/acme"
+)
+
+func TestOrderJournalRestore(t *testing.T) {
+	ca := &fakeCA{authzs: map[string]string{
+		"pending": acme.StatusPending,
+		"valid":   acme.StatusValid,
+	}}
+	server := httptest.NewServer(ca)
+	defer server.Close()
+	ca.url = server.URL
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+	zone := "_acme-challenge.test.domain."
+	var challenges []acme.Challenge
+	var records []libdns.Record
+	// the CA deleted the authorization of the "gone" challenge
+	for _, id := range []string{"pending", "valid", "gone"} {
+		chal := acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			URL:              server.URL + "/authz/" + id,
+			Token:            id,
+			KeyAuthorization: id + ".thumbprint",
+			Identifier:       acme.Identifier{Type: "dns", Value: "test.domain"},
+		}
+		challenges = append(challenges, chal)
+		records = append(records, libdns.Record{Type: "TXT", Value: chal.DNS01KeyAuthorization(), TTL: time.Minute})
+	}
+
+	// the process presenting the challenges stops before cleaning them up,
+	// and before journaling the challenge of its last record
+	journal := &OrderJournal{Storage: storage, Zone: "test.domain"}
+	provider := &Provider{recordMap: make(map[string]*RecordStore), journal: journal}
+	orphan := libdns.Record{Type: "TXT", Value: "orphan", TTL: time.Minute}
+	if _, err := provider.AppendRecords(ctx, zone, append(records, orphan)); err != nil {
+		t.Fatal(err)
+	}
+	for _, chal := range challenges {
+		if err := journal.addChallenge(chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	journal = &OrderJournal{Storage: storage, Zone: "test.domain"}
+	provider = &Provider{recordMap: make(map[string]*RecordStore), journal: journal}
+	pending, err := journal.Restore(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(challenges) {
+		t.Errorf("Error: expected %d challenges to be pending but got %v", len(challenges), pending)
+	}
+	restored, err := provider.GetRecords(ctx, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(records) {
+		t.Errorf("Error: expected %v to be restored without the orphan but got %v", records, restored)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := acme.Account{PrivateKey: key, Location: server.URL + "/account/1"}
+	client := &acme.Client{Directory: server.URL + "/directory"}
+	left, err := journal.CheckRestored(ctx, client, account, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Errorf("Error: expected one challenge to be left pending but got %d", left)
+	}
+	restored, _ = provider.GetRecords(ctx, zone)
+	if len(restored) != 1 || !compareRecords(restored[0], records[0]) {
+		t.Errorf("Error: expected only %v to be kept but got %v", records[0], restored)
+	}
+	record, _ := journal.load()
+	if _, ok := record.Challenges[challenges[0].URL]; len(record.Challenges) != 1 || !ok || len(record.Records) != 1 {
+		t.Errorf("Error: expected only the pending challenge in the journal but got %+v", record)
+	}
+
+	// once the CA is done with it, the last challenge goes too
+	ca.authzs["pending"] = acme.StatusInvalid
+	if left, err := journal.CheckRestored(ctx, client, account, provider); err != nil || left != 0 {
+		t.Errorf("Error: expected no challenge left but got %d: %v", left, err)
+	}
+	if restored, _ := provider.GetRecords(ctx, zone); len(restored) != 0 {
+		t.Errorf("Error: expected restored records to be cleared but got %v", restored)
+	}
+}
+
+func TestOrderJournalForgetIdentifiers(t *testing.T) {
+	ctx := context.Background()
+	journal := &OrderJournal{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Zone: "test.domain"}
+	provider := &Provider{recordMap: make(map[string]*RecordStore), journal: journal}
+	for _, name := range []string{"test.domain", "other.test.domain"} {
+		chal := acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			URL:              "https://ca.example/chall/" + name,
+			KeyAuthorization: name + ".thumbprint",
+			Identifier:       acme.Identifier{Type: "dns", Value: name},
+		}
+		record := libdns.Record{Type: "TXT", Value: chal.DNS01KeyAuthorization()}
+		if _, err := provider.AppendRecords(ctx, chal.DNS01TXTRecordName(), []libdns.Record{record}); err != nil {
+			t.Fatal(err)
+		}
+		if err := journal.addChallenge(chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := journal.forgetIdentifiers(ctx, map[string]bool{"test.domain": true}, provider); err != nil {
+		t.Fatal(err)
+	}
+	record, _ := journal.load()
+	if _, ok := record.Challenges["https://ca.example/chall/other.test.domain"]; len(record.Challenges) != 1 || !ok || len(record.Records) != 1 {
+		t.Errorf("Error: expected only the challenge of other.test.domain to be left but got %+v", record)
+	}
+	if records, _ := provider.GetRecords(ctx, "_acme-challenge.test.domain."); len(records) != 0 {
+		t.Errorf("Error: expected the records of test.domain to be removed but got %v", records)
+	}
+}
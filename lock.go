@@ -0,0 +1,224 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+const (
+	defaultLeaseTTL          = 2 * time.Minute
+	defaultLeasePollInterval = 2 * time.Second
+)
+
+// ErrLeaseLost is returned when another replica took over the issuance
+// lease, so the results of this replica's order must not be used.
+var ErrLeaseLost = errors.New("issuance lease lost to another replica")
+
+// IssuanceLock is a lease in certmagic storage that lets only one of the
+// replicas sharing that storage place ACME orders for a zone. The lease
+// expires unless its holder keeps renewing it, so a crashed replica cannot
+// hold it forever, and every new holder gets a higher token, which fences
+// off a holder that stalled past expiry. It is reentrant within a process.
+type IssuanceLock struct {
+	Storage      certmagic.Storage
+	Name         string
+	Owner        string
+	TTL          time.Duration
+	PollInterval time.Duration
+
+	mu    sync.Mutex
+	held  int
+	token uint64
+	stop  chan struct{}
+}
+
+type leaseRecord struct {
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *IssuanceLock) key() string {
+	return path.Join(storagePrefix, "locks", l.Name+".json")
+}
+
+func (l *IssuanceLock) ttl() time.Duration {
+	if l.TTL == 0 {
+		return defaultLeaseTTL
+	}
+	return l.TTL
+}
+
+// Acquire blocks until this process holds the lease or ctx is done.
+func (l *IssuanceLock) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held > 0 {
+		l.held++
+		return nil
+	}
+	poll := l.PollInterval
+	if poll == 0 {
+		poll = defaultLeasePollInterval
+	}
+	for {
+		token, retryAt, err := l.tryAcquire(ctx)
+		if err != nil {
+			// certmagic's file locks can briefly fail to decode while another
+			// process is creating them, so errors are retried like contention
+			log.Warningf("acquiring issuance lease for %s: %v", l.Name, err)
+		} else if token != 0 {
+			l.held, l.token, l.stop = 1, token, make(chan struct{})
+			go l.keepAlive(l.token, l.stop)
+			return nil
+		}
+		wait := time.Until(retryAt)
+		if wait > poll || wait <= 0 {
+			wait = poll
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tryAcquire takes the lease if it is free or expired, returning its new
+// token, or else the time at which the current lease expires.
+func (l *IssuanceLock) tryAcquire(ctx context.Context) (uint64, time.Time, error) {
+	var token uint64
+	var expires time.Time
+	err := l.update(ctx, func(record *leaseRecord) bool {
+		now := time.Now()
+		if record.Owner != "" && now.Before(record.Expires) {
+			expires = record.Expires
+			return false
+		}
+		record.Owner, record.Token, record.Expires = l.Owner, record.Token+1, now.Add(l.ttl())
+		token = record.Token
+		return true
+	})
+	return token, expires, err
+}
+
+func (l *IssuanceLock) keepAlive(token uint64, stop chan struct{}) {
+	ticker := time.NewTicker(l.ttl() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		lost := false
+		err := l.update(context.Background(), func(record *leaseRecord) bool {
+			if record.Owner != l.Owner || record.Token != token {
+				lost = true
+				return false
+			}
+			record.Expires = time.Now().Add(l.ttl())
+			return true
+		})
+		if err == nil && lost {
+			// the next Acquire must contend for the lease again, and Check
+			// fences off the order in progress
+			log.Warningf("Issuance lease for %s lost to another replica", l.Name)
+			l.mu.Lock()
+			if l.token == token {
+				l.held, l.token = 0, 0
+			}
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Check fences off a holder whose lease was taken over: it fails unless
+// this process still holds the current lease.
+func (l *IssuanceLock) Check() error {
+	l.mu.Lock()
+	token := l.token
+	l.mu.Unlock()
+	if token == 0 {
+		return ErrLeaseLost
+	}
+	record, err := l.load()
+	if err != nil {
+		return err
+	}
+	if record.Owner != l.Owner || record.Token != token || !time.Now().Before(record.Expires) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Release gives the lease up once every Acquire in this process has been
+// released.
+func (l *IssuanceLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held == 0 {
+		return nil
+	}
+	l.held--
+	if l.held > 0 {
+		return nil
+	}
+	close(l.stop)
+	token := l.token
+	l.token = 0
+	return l.update(context.Background(), func(record *leaseRecord) bool {
+		if record.Owner != l.Owner || record.Token != token {
+			return false
+		}
+		// the token is kept so that the next holder's is higher
+		record.Owner, record.Expires = "", time.Time{}
+		return true
+	})
+}
+
+func (l *IssuanceLock) load() (leaseRecord, error) {
+	var record leaseRecord
+	data, err := l.Storage.Load(l.key())
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		return record, nil
+	}
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("decoding lease %s: %v", l.key(), err)
+	}
+	return record, nil
+}
+
+// update applies f to the lease record under the storage lock, storing the
+// record when f reports a change.
+func (l *IssuanceLock) update(ctx context.Context, f func(*leaseRecord) bool) error {
+	key := l.key()
+	if err := l.Storage.Lock(ctx, key); err != nil {
+		return err
+	}
+	defer l.Storage.Unlock(key)
+	record, err := l.load()
+	if err != nil {
+		return err
+	}
+	if !f(&record) {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return l.Storage.Store(key, data)
+}
@@ -0,0 +1,161 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/google/uuid"
+)
+
+const lockHelperDir = "COREDNS_ACME_LOCK_HELPER_DIR"
+
+// TestIssuanceLockHelper is run by TestIssuanceLockProcesses in separate
+// processes. Each one orders a certificate unless another process already
+// stored one, the way IssueCert only loads what the lease holder stored.
+func TestIssuanceLockHelper(t *testing.T) {
+	dir := os.Getenv(lockHelperDir)
+	if dir == "" {
+		t.Skip("only run as a helper process")
+	}
+	storage := &certmagic.FileStorage{Path: dir}
+	lock := &IssuanceLock{Storage: storage, Name: "test.domain", Owner: uuid.New().String(), PollInterval: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := lock.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	if storage.Exists("certificate") {
+		return
+	}
+	// placing the order takes a while, long enough for the other processes
+	// to contend for the lease
+	time.Sleep(200 * time.Millisecond)
+	if err := lock.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(path.Join("orders", lock.Owner), []byte(lock.Owner)); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store("certificate", []byte(lock.Owner)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssuanceLockProcesses(t *testing.T) {
+	dir := t.TempDir()
+	var cmds []*exec.Cmd
+	var outputs []*bytes.Buffer
+	for i := 0; i < 4; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestIssuanceLockHelper$", "-test.count=1")
+		cmd.Env = append(os.Environ(), lockHelperDir+"="+dir)
+		output := &bytes.Buffer{}
+		cmd.Stdout, cmd.Stderr = output, output
+		outputs = append(outputs, output)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("Error: helper process %d failed: %v\n%s", i, err, outputs[i])
+		}
+	}
+	storage := &certmagic.FileStorage{Path: dir}
+	orders, err := storage.List("orders", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 {
+		t.Errorf("Error: expected a single order from %d processes but got %d", len(cmds), len(orders))
+	}
+}
+
+func TestIssuanceLockFencing(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	first := &IssuanceLock{Storage: storage, Name: "test.domain", Owner: "first", TTL: time.Hour}
+	second := &IssuanceLock{Storage: storage, Name: "test.domain", Owner: "second", TTL: time.Hour, PollInterval: 10 * time.Millisecond}
+	ctx := context.Background()
+	if err := first.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// reentrant within the process
+	if err := first.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first.Release()
+	if err := first.Check(); err != nil {
+		t.Errorf("Error: expected the first lock to hold the lease: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := second.Acquire(waitCtx); err == nil {
+		t.Errorf("Error: expected the second lock to wait for the lease")
+	}
+
+	// the first holder stalls past the lease's expiry
+	expired, _ := json.Marshal(leaseRecord{Owner: "first", Token: 1, Expires: time.Now().Add(-time.Second)})
+	if err := storage.Store(first.key(), expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Check(); err != ErrLeaseLost {
+		t.Errorf("Error: expected the first lock to be fenced off but got %v", err)
+	}
+	if err := second.Check(); err != nil {
+		t.Errorf("Error: expected the second lock to hold the lease: %v", err)
+	}
+	record, err := second.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Token != 2 {
+		t.Errorf("Error: expected token 2 but got %d", record.Token)
+	}
+	// releasing a lost lease leaves the new holder's lease alone
+	first.Release()
+	if err := second.Check(); err != nil {
+		t.Errorf("Error: expected the second lock to keep the lease: %v", err)
+	}
+	second.Release()
+}
+
+func TestIssuanceLockLost(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	lock := &IssuanceLock{Storage: storage, Name: "test.domain", Owner: "first", TTL: 300 * time.Millisecond, PollInterval: 10 * time.Millisecond}
+	ctx := context.Background()
+	if err := lock.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	taken, _ := json.Marshal(leaseRecord{Owner: "second", Token: 2, Expires: time.Now().Add(time.Hour)})
+	if err := storage.Store(lock.key(), taken); err != nil {
+		t.Fatal(err)
+	}
+	// the renewal finds the lease taken over
+	time.Sleep(200 * time.Millisecond)
+	lock.mu.Lock()
+	held, token := lock.held, lock.token
+	lock.mu.Unlock()
+	if held != 0 || token != 0 {
+		t.Errorf("Error: expected the lost lease to be cleared but got held %d and token %d", held, token)
+	}
+	if err := lock.Check(); err != ErrLeaseLost {
+		t.Errorf("Error: expected the lock to be fenced off but got %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := lock.Acquire(waitCtx); err == nil {
+		t.Errorf("Error: expected Acquire to wait for the other replica's lease")
+	}
+}
@@ -0,0 +1,28 @@
+package acme
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// temporaryCertificate is 1 while a zone's TLS server is serving the
+	// self-signed certificate generated at setup.
+	temporaryCertificate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "temporary_certificate",
+		Help:      "Whether a temporary self-signed certificate is served in place of the managed one.",
+	}, []string{"zone"})
+
+	// policyDenials counts the names the name policy refused to request
+	// certificates for.
+	policyDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "policy_denials_total",
+		Help:      "Counter of names denied by the name policy, by reason.",
+	}, []string{"zone", "reason"})
+)
@@ -0,0 +1,131 @@
+package acme
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OnDemandPolicy decides which SNI names under the zone may get a
+// certificate issued during the TLS handshake. A name is allowed when it
+// is listed in Allow, matches one of Regex, or the Ask endpoint answers
+// with a 2xx status.
+type OnDemandPolicy struct {
+	Zone     string
+	Allow    []string
+	Regex    []*regexp.Regexp
+	Ask      string
+	Rate     RateLimit
+	MaxCerts int
+	// Inventory holds the certificates MaxCerts counts, those issued for
+	// names under the zone other than the zone itself. Kept in storage, the
+	// count survives restarts and is shared by replicas.
+	Inventory *Inventory
+
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+	client   *http.Client
+}
+
+func newOnDemandPolicy(zone string) *OnDemandPolicy {
+	return &OnDemandPolicy{
+		Zone:     zone,
+		attempts: make(map[string][]time.Time),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OnDemandPolicy) hasAllowPolicy() bool {
+	return len(p.Allow) > 0 || len(p.Regex) > 0 || p.Ask != ""
+}
+
+// Decide is used as certmagic's on-demand DecisionFunc. It returns an error
+// explaining why a certificate must not be obtained for name.
+func (p *OnDemandPolicy) Decide(name string) error {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone := strings.ToLower(strings.TrimSuffix(p.Zone, "."))
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		return fmt.Errorf("%s is not under zone %s", name, zone)
+	}
+	allowed, err := p.allowed(name)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%s is not allowed by the on-demand policy", name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.Rate.Limit > 0 {
+		attempts := p.attempts[name][:0]
+		for _, t := range p.attempts[name] {
+			if now.Sub(t) < p.Rate.Window {
+				attempts = append(attempts, t)
+			}
+		}
+		if len(attempts) >= p.Rate.Limit {
+			p.attempts[name] = attempts
+			return fmt.Errorf("on-demand rate limit of %d per %s reached for %s; next attempt possible at %s",
+				p.Rate.Limit, p.Rate.Window, name, attempts[0].Add(p.Rate.Window).UTC().Format(time.RFC3339))
+		}
+		p.attempts[name] = append(attempts, now)
+	}
+	if p.MaxCerts > 0 && p.Inventory != nil {
+		return p.checkCap(name, zone)
+	}
+	return nil
+}
+
+// checkCap refuses name when it has no certificate yet and MaxCerts
+// certificates were already issued on demand. Only issuances that
+// succeeded are in the inventory with a certificate.
+func (p *OnDemandPolicy) checkCap(name, zone string) error {
+	statuses, err := p.Inventory.List()
+	if err != nil {
+		return fmt.Errorf("counting on-demand certificates: %v", err)
+	}
+	issued := 0
+	for _, status := range statuses {
+		if status.Serial == "" {
+			continue
+		}
+		if status.Name == name {
+			return nil
+		}
+		if strings.HasSuffix(status.Name, "."+zone) {
+			issued++
+		}
+	}
+	if issued >= p.MaxCerts {
+		return fmt.Errorf("on-demand certificate cap of %d reached, refusing %s", p.MaxCerts, name)
+	}
+	return nil
+}
+
+func (p *OnDemandPolicy) allowed(name string) (bool, error) {
+	for _, allow := range p.Allow {
+		if strings.EqualFold(strings.TrimSuffix(allow, "."), name) {
+			return true, nil
+		}
+	}
+	for _, re := range p.Regex {
+		if re.MatchString(name) {
+			return true, nil
+		}
+	}
+	if p.Ask == "" {
+		return false, nil
+	}
+	resp, err := p.client.Get(p.Ask + "?domain=" + url.QueryEscape(name))
+	if err != nil {
+		return false, fmt.Errorf("asking %s about %s: %v", p.Ask, name, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+}
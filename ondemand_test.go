@@ -0,0 +1,117 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestOnDemandDecide(t *testing.T) {
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("domain") == "asked.dns.example.com" {
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ask.Close()
+
+	policy := newOnDemandPolicy("dns.example.com.")
+	policy.Allow = []string{"listed.dns.example.com"}
+	policy.Regex = []*regexp.Regexp{regexp.MustCompile(`^t[0-9]+\.dns\.example\.com$`)}
+	policy.Ask = ask.URL
+	policy.Rate = RateLimit{Limit: 2, Window: time.Hour}
+
+	tests := []struct {
+		name      string
+		sni       string
+		shouldErr bool
+	}{
+		{"Listed name", "listed.dns.example.com", false},
+		{"Regex match", "t123.dns.example.com", false},
+		{"Ask endpoint allows", "asked.dns.example.com", false},
+		{"Ask endpoint denies", "denied.dns.example.com", true},
+		{"Outside the zone", "t123.dns.example.org", true},
+		{"Look-alike suffix", "t1.evildns.example.com", true},
+		{"Second attempt within rate", "t123.dns.example.com", false},
+		{"Third attempt over rate", "t123.dns.example.com", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Decide(test.sni)
+			if (err != nil) != test.shouldErr {
+				t.Errorf("Error: Decide(%s) error = %v, shouldErr %v", test.sni, err, test.shouldErr)
+			}
+		})
+	}
+}
+
+func TestOnDemandCap(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := func(name string) *x509.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			DNSNames:     []string{name},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	inventory := &Inventory{Storage: storage}
+	newPolicy := func() *OnDemandPolicy {
+		policy := newOnDemandPolicy("dns.example.com.")
+		policy.Regex = []*regexp.Regexp{regexp.MustCompile(`^t[0-9]+\.dns\.example\.com$`)}
+		policy.MaxCerts = 2
+		policy.Inventory = inventory
+		return policy
+	}
+	policy := newPolicy()
+	// neither the zone's own certificate nor failed issuances count
+	for _, name := range []string{"dns.example.com", "t1.dns.example.com"} {
+		if err := inventory.recordCertificate(name, leaf(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inventory.recordAttempt("t2.dns.example.com", nil, errors.New("validation failed")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"t2.dns.example.com", "t3.dns.example.com"} {
+		if err := policy.Decide(name); err != nil {
+			t.Errorf("Error: expected %s under the cap but got %v", name, err)
+		}
+	}
+	if err := inventory.recordCertificate("t3.dns.example.com", leaf("t3.dns.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Decide("t4.dns.example.com"); err == nil {
+		t.Errorf("Error: expected t4.dns.example.com over the cap")
+	}
+	if err := policy.Decide("t3.dns.example.com"); err != nil {
+		t.Errorf("Error: expected the certificate of t3.dns.example.com to be renewable but got %v", err)
+	}
+	// the cap holds after a restart
+	if err := newPolicy().Decide("t4.dns.example.com"); err == nil {
+		t.Errorf("Error: expected t4.dns.example.com over the cap after a restart")
+	}
+}
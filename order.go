@@ -0,0 +1,256 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// journaledOrder places and resumes the orders kept in the journal, and
+// solves their DNS-01 challenges with solver. acmez places a new order on
+// every attempt, so orders that must survive a restart are driven here
+// with its lower-level client.
+type journaledOrder struct {
+	journal  *OrderJournal
+	provider *Provider
+	client   *acme.Client
+	account  acme.Account
+	solver   acmez.Solver
+}
+
+// obtain returns the certificate chains for csr. The order a previous
+// process left for the same names is resumed when the CA can still
+// complete it; otherwise reserve is called before a new order is placed.
+// The order stays in the journal until it is finalized or the CA can no
+// longer complete it.
+func (o journaledOrder) obtain(ctx context.Context, csr *x509.CertificateRequest, reserve func() error) ([]acme.Certificate, error) {
+	identifiers := orderIdentifiers(csr)
+	order, found, err := o.journal.findOrder(identifiers)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		order.Status, err = orderStatus(ctx, o.client, o.account, order.Location)
+		if err != nil {
+			return nil, err
+		}
+		if resumable(order.Status) {
+			log.Infof("Resuming %s order %s for %s", order.Status, order.Location, csrName(csr))
+		} else {
+			log.Infof("Not resuming %s order %s for %s", order.Status, order.Location, csrName(csr))
+			if err := o.journal.removeOrder(order.Location); err != nil {
+				return nil, err
+			}
+			found = false
+		}
+	}
+	if !found {
+		if err := reserve(); err != nil {
+			return nil, err
+		}
+		order, err = o.client.NewOrder(ctx, o.account, acme.Order{Identifiers: identifiers})
+		if err != nil {
+			return nil, fmt.Errorf("creating new order: %w", err)
+		}
+		if err := o.journal.addOrder(order); err != nil {
+			log.Warningf("journaling order %s: %v", order.Location, err)
+		}
+	}
+	certs, err := o.complete(ctx, order, csr)
+	if err != nil {
+		// the order is kept for the next attempt unless the CA gave up on it
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), authzCleanupTimeout)
+		defer cancel()
+		if status, statusErr := orderStatus(cleanupCtx, o.client, o.account, order.Location); statusErr == nil && !resumable(status) {
+			if err := o.journal.removeOrder(order.Location); err != nil {
+				log.Warningf("journaling order %s: %v", order.Location, err)
+			}
+		}
+		return nil, err
+	}
+	if err := o.journal.removeOrder(order.Location); err != nil {
+		log.Warningf("journaling order %s: %v", order.Location, err)
+	}
+	return certs, nil
+}
+
+// complete solves the authorizations of order that are not valid yet,
+// finalizes it with csr and downloads the certificate chains.
+func (o journaledOrder) complete(ctx context.Context, order acme.Order, csr *x509.CertificateRequest) ([]acme.Certificate, error) {
+	if order.Status != acme.StatusReady {
+		for _, url := range order.Authorizations {
+			authz, err := o.client.GetAuthorization(ctx, o.account, url)
+			if err != nil {
+				return nil, fmt.Errorf("getting authorization %s: %w", url, err)
+			}
+			if err := o.authorize(ctx, authz); err != nil {
+				return nil, err
+			}
+		}
+	}
+	order, err := o.client.FinalizeOrder(ctx, o.account, order, csr.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("finalizing order %s: %w", order.Location, err)
+	}
+	certs, err := o.client.GetCertificateChain(ctx, o.account, order.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("downloading certificate chain from %s: %w", order.Certificate, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate chains for order %s", order.Location)
+	}
+	return certs, nil
+}
+
+// authorize solves the DNS-01 challenge of authz unless it is valid. A
+// challenge the CA is already validating, such as one whose records were
+// restored from the journal, is only waited for.
+func (o journaledOrder) authorize(ctx context.Context, authz acme.Authorization) error {
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == acme.ChallengeTypeDNS01 {
+			chal = c
+		}
+	}
+	if chal.URL == "" {
+		return fmt.Errorf("authorization %s offers no %s challenge", authz.Location, acme.ChallengeTypeDNS01)
+	}
+	if chal.Status == acme.StatusPending {
+		if err := o.solver.Present(ctx, chal); err != nil {
+			return fmt.Errorf("presenting %s challenge for %s: %w", chal.Type, chal.Identifier.Value, err)
+		}
+		defer func() {
+			if err := o.solver.CleanUp(context.Background(), chal); err != nil {
+				log.Warningf("cleaning up %s challenge for %s: %v", chal.Type, chal.Identifier.Value, err)
+			}
+		}()
+		if waiter, ok := o.solver.(acmez.Waiter); ok {
+			if err := waiter.Wait(ctx, chal); err != nil {
+				return fmt.Errorf("waiting for %s challenge for %s: %w", chal.Type, chal.Identifier.Value, err)
+			}
+		}
+		if _, err := o.client.InitiateChallenge(ctx, o.account, chal); err != nil {
+			return fmt.Errorf("initiating %s challenge for %s: %w", chal.Type, chal.Identifier.Value, err)
+		}
+	} else {
+		defer func() {
+			if err := o.journal.forget(context.Background(), chal, o.provider); err != nil {
+				log.Warningf("cleaning up %s challenge for %s: %v", chal.Type, chal.Identifier.Value, err)
+			}
+		}()
+	}
+	_, err := o.client.PollAuthorization(ctx, o.account, authz)
+	return err
+}
+
+// orderIdentifiers returns the identifiers of an order for the DNS names
+// of csr.
+func orderIdentifiers(csr *x509.CertificateRequest) []acme.Identifier {
+	var identifiers []acme.Identifier
+	for _, name := range csr.DNSNames {
+		identifiers = append(identifiers, acme.Identifier{Type: "dns", Value: name})
+	}
+	return identifiers
+}
+
+// issueJournaled issues the certificate for csr through an order kept in
+// the journal, registering the ACME account first if none is stored yet.
+func (i acmeIssuer) issueJournaled(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	client := &acme.Client{Directory: i.CA}
+	account, err := i.registeredAccount(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	o := journaledOrder{
+		journal:  i.provider.journal,
+		provider: i.provider,
+		client:   client,
+		account:  account,
+		solver:   i.DNS01Solver,
+	}
+	certs, err := o.obtain(ctx, csr, func() error {
+		return i.ledger.ReserveOrder(ctx, csrNames(csr))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v %w (ca=%s)", csrNames(csr), err, i.CA)
+	}
+	// no preferred chains are configured, so the CA's default is used
+	return &certmagic.IssuedCertificate{Certificate: certs[0].ChainPEM, Metadata: certs[0]}, nil
+}
+
+// registeredAccount returns the issuer's ACME account, registering one
+// with the CA when none is stored yet, the way certmagic would.
+func (i acmeIssuer) registeredAccount(ctx context.Context, client *acme.Client) (acme.Account, error) {
+	account, err := i.account(ctx)
+	if err == nil || !errors.Is(err, errNoAccount) {
+		return account, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("generating account key: %v", err)
+	}
+	account = acme.Account{PrivateKey: key, TermsOfServiceAgreed: true}
+	if i.Email != "" {
+		account.Contact = []string{"mailto:" + i.Email}
+	}
+	if i.NewAccountFunc != nil {
+		if account, err = i.NewAccountFunc(ctx, i.ACMEManager, account); err != nil {
+			return acme.Account{}, fmt.Errorf("account pre-registration callback: %v", err)
+		}
+	}
+	if i.ExternalAccount != nil {
+		if err := account.SetExternalAccountBinding(ctx, client, *i.ExternalAccount); err != nil {
+			return acme.Account{}, err
+		}
+	}
+	account, err = client.NewAccount(ctx, account)
+	if err != nil {
+		return acme.Account{}, fmt.Errorf("registering account %v with server: %w", account.Contact, err)
+	}
+	return account, i.saveAccount(account)
+}
+
+// saveAccount stores account where certmagic loads accounts from: in the
+// folder of the email, or "default" without one, in files named after
+// its local part.
+func (i acmeIssuer) saveAccount(account acme.Account) error {
+	user := "default"
+	if i.Email != "" {
+		user = strings.ToLower(i.Email)
+	}
+	filename := user
+	if at := strings.Index(user, "@"); at == 0 {
+		filename = user[1:]
+	} else if at > 0 {
+		filename = user[:at]
+	}
+	prefix := path.Join("acme", certmagic.StorageKeys.Safe(i.IssuerKey()), "users", certmagic.StorageKeys.Safe(user), certmagic.StorageKeys.Safe(filename))
+	registration, err := json.MarshalIndent(account, "", "\t")
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(account.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	if err := i.ledger.Storage.Store(prefix+".json", registration); err != nil {
+		return err
+	}
+	return i.ledger.Storage.Store(prefix+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
@@ -0,0 +1,268 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/acme"
+)
+
+// fakeOrderCA answers enough of RFC 8555 to place orders with one DNS-01
+// authorization each, validate them once their challenge is initiated, and
+// finalize them. Orders whose status is set stay in it.
+type fakeOrderCA struct {
+	mu        sync.Mutex
+	url       string
+	newOrders int
+	orders    map[string]*acme.Order
+	authzs    map[string]*acme.Authorization
+}
+
+func (ca *fakeOrderCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := parts[len(parts)-1]
+	switch parts[0] {
+	case "directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.url + "/nonce",
+			"newAccount": ca.url + "/account",
+			"newOrder":   ca.url + "/new-order",
+		})
+	case "nonce":
+	case "new-order":
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		json.NewDecoder(r.Body).Decode(&jws)
+		var order acme.Order
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(payload, &order)
+		ca.newOrders++
+		id := fmt.Sprint(len(ca.orders) + 1)
+		ca.placeOrder(id, order.Identifiers[0].Value, acme.StatusPending)
+		w.Header().Set("Location", ca.url+"/order/"+id)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ca.orderStatus(id))
+	case "order":
+		if _, ok := ca.orders[id]; !ok {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(acme.Problem{Type: "urn:ietf:params:acme:error:malformed", Status: http.StatusNotFound})
+			return
+		}
+		json.NewEncoder(w).Encode(ca.orderStatus(id))
+	case "authz":
+		json.NewEncoder(w).Encode(ca.authzs[id])
+	case "chall":
+		// the CA validates the challenge right away
+		authz := ca.authzs[id]
+		authz.Status = acme.StatusValid
+		authz.Challenges[0].Status = acme.StatusValid
+		json.NewEncoder(w).Encode(authz.Challenges[0])
+	case "finalize":
+		order := ca.orderStatus(id)
+		if order.Status != acme.StatusReady {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(acme.Problem{Type: acme.ProblemTypeOrderNotReady, Status: http.StatusForbidden})
+			return
+		}
+		ca.orders[id].Status = acme.StatusValid
+		json.NewEncoder(w).Encode(ca.orderStatus(id))
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		fmt.Fprintf(w, "-----BEGIN CERTIFICATE-----\n%s\n-----END CERTIFICATE-----\n", id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// placeOrder adds an order for name with one pending authorization, whose
+// status follows the authorization unless status is set.
+func (ca *fakeOrderCA) placeOrder(id, name, status string) acme.Order {
+	ca.authzs[id] = &acme.Authorization{
+		Identifier: acme.Identifier{Type: "dns", Value: name},
+		Status:     acme.StatusPending,
+		Challenges: []acme.Challenge{{Type: acme.ChallengeTypeDNS01, URL: ca.url + "/chall/" + id, Token: "token" + id, Status: acme.StatusPending}},
+	}
+	ca.orders[id] = &acme.Order{
+		Status:         status,
+		Identifiers:    []acme.Identifier{{Type: "dns", Value: name}},
+		Authorizations: []string{ca.url + "/authz/" + id},
+		Finalize:       ca.url + "/finalize/" + id,
+		Location:       ca.url + "/order/" + id,
+	}
+	return *ca.orders[id]
+}
+
+func (ca *fakeOrderCA) orderStatus(id string) acme.Order {
+	order := *ca.orders[id]
+	switch {
+	case order.Status == acme.StatusValid:
+		order.Certificate = ca.url + "/cert/" + id
+	case order.Status == acme.StatusPending && ca.authzs[id].Status == acme.StatusValid:
+		order.Status = acme.StatusReady
+	}
+	return order
+}
+
+// providerSolver presents DNS-01 challenges in a Provider.
+type providerSolver struct {
+	provider  *Provider
+	presented int
+}
+
+func (s *providerSolver) Present(ctx context.Context, chal acme.Challenge) error {
+	s.presented++
+	record := libdns.Record{Type: "TXT", Value: chal.DNS01KeyAuthorization()}
+	_, err := s.provider.AppendRecords(ctx, chal.DNS01TXTRecordName(), []libdns.Record{record})
+	return err
+}
+
+func (s *providerSolver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	record := libdns.Record{Type: "TXT", Value: chal.DNS01KeyAuthorization()}
+	_, err := s.provider.DeleteRecords(ctx, chal.DNS01TXTRecordName(), []libdns.Record{record})
+	return err
+}
+
+func TestJournaledOrderResume(t *testing.T) {
+	ca := &fakeOrderCA{orders: make(map[string]*acme.Order), authzs: make(map[string]*acme.Authorization)}
+	server := httptest.NewServer(ca)
+	defer server.Close()
+	ca.url = server.URL
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrFor := func(name string) *x509.CertificateRequest {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+	account := acme.Account{PrivateKey: key, Location: server.URL + "/account/1"}
+	client := &acme.Client{Directory: server.URL + "/directory", PollInterval: 10 * time.Millisecond}
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+	newOrderer := func() (journaledOrder, *providerSolver) {
+		journal := &OrderJournal{Storage: storage, Zone: "test.domain"}
+		provider := &Provider{recordMap: make(map[string]*RecordStore), journal: journal}
+		if _, err := journal.Restore(provider); err != nil {
+			t.Fatal(err)
+		}
+		solver := &providerSolver{provider: provider}
+		return journaledOrder{
+			journal:  journal,
+			provider: provider,
+			client:   client,
+			account:  account,
+			solver:   journalingSolver{Solver: solver, journal: journal},
+		}, solver
+	}
+	reserved := 0
+	reserve := func() error {
+		reserved++
+		return nil
+	}
+
+	// the first process places the order and presents its challenge, then
+	// stops before the CA is asked to validate it
+	o, _ := newOrderer()
+	order, err := client.NewOrder(ctx, account, acme.Order{Identifiers: orderIdentifiers(csrFor("test.domain"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.journal.addOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	authz, err := client.GetAuthorization(ctx, account, order.Authorizations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.solver.Present(ctx, authz.Challenges[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next one resumes it instead of placing a new order
+	o, solver := newOrderer()
+	if records, _ := o.provider.GetRecords(ctx, "_acme-challenge.test.domain"); len(records) != 1 {
+		t.Fatalf("Error: expected the challenge record to be restored but got %v", records)
+	}
+	certs, err := o.obtain(ctx, csrFor("test.domain"), reserve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.newOrders != 1 || reserved != 0 || solver.presented != 1 {
+		t.Errorf("Error: expected the order to be resumed but got %d orders, %d reserved and %d challenges presented", ca.newOrders, reserved, solver.presented)
+	}
+	if len(certs) != 1 || !strings.Contains(string(certs[0].ChainPEM), "1") {
+		t.Errorf("Error: expected the certificate of order 1 but got %v", certs)
+	}
+	record, _ := o.journal.load()
+	if len(record.Orders) != 0 || len(record.Challenges) != 0 || len(record.Records) != 0 {
+		t.Errorf("Error: expected the finalized order to leave the journal but got %+v", record)
+	}
+	if records, _ := o.provider.GetRecords(ctx, "_acme-challenge.test.domain"); len(records) != 0 {
+		t.Errorf("Error: expected the challenge records to be removed but got %v", records)
+	}
+
+	// an order the CA gave up on is replaced by a new one
+	ca.mu.Lock()
+	expired := ca.placeOrder("2", "other.test.domain", acme.StatusInvalid)
+	ca.mu.Unlock()
+	if err := o.journal.addOrder(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.obtain(ctx, csrFor("other.test.domain"), reserve); err != nil {
+		t.Fatal(err)
+	}
+	if ca.newOrders != 2 || reserved != 1 {
+		t.Errorf("Error: expected a new order to be placed but got %d orders and %d reserved", ca.newOrders, reserved)
+	}
+	if record, _ := o.journal.load(); len(record.Orders) != 0 {
+		t.Errorf("Error: expected no order left in the journal but got %+v", record.Orders)
+	}
+
+	// orders the CA can no longer complete are dropped while checking
+	ca.mu.Lock()
+	pending := ca.placeOrder("4", "pending.test.domain", acme.StatusPending)
+	ca.mu.Unlock()
+	unknown := acme.Order{Location: server.URL + "/order/5", Identifiers: orderIdentifiers(csrFor("unknown.test.domain"))}
+	for _, order := range []acme.Order{pending, unknown} {
+		if err := o.journal.addOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	left, err := o.journal.CheckRestored(ctx, client, account, o.provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ = o.journal.load()
+	if _, ok := record.Orders[pending.Location]; left != 1 || len(record.Orders) != 1 || !ok {
+		t.Errorf("Error: expected only the pending order to be kept but got %d left and %+v", left, record.Orders)
+	}
+}
@@ -0,0 +1,129 @@
+package acme
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Reasons a NamePolicy denies names for, used as the reason label of the
+// denial metric.
+const (
+	DeniedName      = "deny"
+	DeniedSuffix    = "deny_suffix"
+	DeniedRegex     = "deny_regex"
+	DeniedNotListed = "not_allowed"
+	DeniedSANs      = "max_sans"
+	DeniedLabels    = "max_labels"
+)
+
+// NamePolicy restricts the names the plugin requests certificates for, on
+// every issuance path. Deny rules win over allow rules, and once any allow
+// rule is configured a name must match one of them. IP addresses are only
+// counted towards MaxSANs.
+type NamePolicy struct {
+	Zone        string
+	Allow       []string
+	AllowSuffix []string
+	AllowRegex  []*regexp.Regexp
+	Deny        []string
+	DenySuffix  []string
+	DenyRegex   []*regexp.Regexp
+	// MaxSANs caps the number of names requested at once, and MaxLabels the
+	// number of labels of each name. 0 means no cap.
+	MaxSANs   int
+	MaxLabels int
+}
+
+// PolicyError explains why a NamePolicy denied a name.
+type PolicyError struct {
+	Name   string
+	Reason string
+	Detail string
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("%s denied by the name policy: %s", e.Name, e.Detail)
+}
+
+// Check returns a PolicyError for the first of names the policy denies,
+// logging and counting the denial. A nil policy allows every name.
+func (p *NamePolicy) Check(names []string) error {
+	if p == nil {
+		return nil
+	}
+	err := p.check(names)
+	if err, ok := err.(PolicyError); ok {
+		log.Warning(err)
+		policyDenials.WithLabelValues(p.Zone, err.Reason).Inc()
+	}
+	return err
+}
+
+func (p *NamePolicy) check(names []string) error {
+	if p.MaxSANs > 0 && len(names) > p.MaxSANs {
+		return PolicyError{Name: strings.Join(names, ", "), Reason: DeniedSANs,
+			Detail: fmt.Sprintf("%d names requested at once, at most %d allowed", len(names), p.MaxSANs)}
+	}
+	dnsNames, _ := splitIdentifiers(names)
+	for _, name := range dnsNames {
+		if err := p.checkName(strings.ToLower(strings.TrimSuffix(name, "."))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *NamePolicy) checkName(name string) error {
+	if labels := strings.Count(name, ".") + 1; p.MaxLabels > 0 && labels > p.MaxLabels {
+		return PolicyError{Name: name, Reason: DeniedLabels,
+			Detail: fmt.Sprintf("%d labels, at most %d allowed", labels, p.MaxLabels)}
+	}
+	for _, deny := range p.Deny {
+		if equalNames(deny, name) {
+			return PolicyError{Name: name, Reason: DeniedName, Detail: "listed in deny"}
+		}
+	}
+	for _, suffix := range p.DenySuffix {
+		if hasNameSuffix(name, suffix) {
+			return PolicyError{Name: name, Reason: DeniedSuffix, Detail: fmt.Sprintf("under denied suffix %s", suffix)}
+		}
+	}
+	for _, re := range p.DenyRegex {
+		if re.MatchString(name) {
+			return PolicyError{Name: name, Reason: DeniedRegex, Detail: fmt.Sprintf("matches denied regex %s", re)}
+		}
+	}
+	if len(p.Allow) == 0 && len(p.AllowSuffix) == 0 && len(p.AllowRegex) == 0 {
+		return nil
+	}
+	for _, allow := range p.Allow {
+		if equalNames(allow, name) {
+			return nil
+		}
+	}
+	for _, suffix := range p.AllowSuffix {
+		if hasNameSuffix(name, suffix) {
+			return nil
+		}
+	}
+	for _, re := range p.AllowRegex {
+		if re.MatchString(name) {
+			return nil
+		}
+	}
+	return PolicyError{Name: name, Reason: DeniedNotListed, Detail: "matches no allow rule"}
+}
+
+func equalNames(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// hasNameSuffix reports whether name is suffix or a subdomain of it, so that
+// example.com does not match badexample.com.
+func hasNameSuffix(name, suffix string) bool {
+	suffix = strings.ToLower(strings.Trim(suffix, "."))
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
@@ -0,0 +1,67 @@
+package acme
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNamePolicy(t *testing.T) {
+	policy := &NamePolicy{
+		Zone:        "policy.example.com",
+		Allow:       []string{"listed.example.org"},
+		AllowSuffix: []string{"policy.example.com"},
+		AllowRegex:  []*regexp.Regexp{regexp.MustCompile(`^t[0-9]+\.example\.net$`)},
+		Deny:        []string{"admin.policy.example.com"},
+		DenySuffix:  []string{".internal.policy.example.com"},
+		DenyRegex:   []*regexp.Regexp{regexp.MustCompile(`^xn--`)},
+		MaxSANs:     2,
+		MaxLabels:   5,
+	}
+	tests := []struct {
+		name   string
+		names  []string
+		reason string
+	}{
+		{"Zone apex", []string{"policy.example.com"}, ""},
+		{"Under allowed suffix", []string{"dns.policy.example.com."}, ""},
+		{"Listed name", []string{"LISTED.example.org"}, ""},
+		{"Allowed regex", []string{"t42.example.net"}, ""},
+		{"IP address", []string{"policy.example.com", "203.0.113.5"}, ""},
+		{"Denied name", []string{"admin.policy.example.com"}, DeniedName},
+		{"Under denied suffix", []string{"db.internal.policy.example.com"}, DeniedSuffix},
+		{"Denied regex", []string{"xn--80ak6aa92e.policy.example.com"}, DeniedRegex},
+		{"Look-alike suffix", []string{"evilpolicy.example.com"}, DeniedNotListed},
+		{"Outside every allow rule", []string{"example.org"}, DeniedNotListed},
+		{"Too many labels", []string{"a.b.c.policy.example.com"}, DeniedLabels},
+		{"Too many names", []string{"policy.example.com", "dns.policy.example.com", "203.0.113.5"}, DeniedSANs},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := testutil.ToFloat64(policyDenials.WithLabelValues(policy.Zone, test.reason))
+			err := policy.Check(test.names)
+			if test.reason == "" {
+				if err != nil {
+					t.Fatalf("Error: expected %v to be allowed but got %v", test.names, err)
+				}
+				return
+			}
+			policyErr, ok := err.(PolicyError)
+			if !ok || policyErr.Reason != test.reason {
+				t.Fatalf("Error: expected %v to be denied with reason %s but got %v", test.names, test.reason, err)
+			}
+			if after := testutil.ToFloat64(policyDenials.WithLabelValues(policy.Zone, test.reason)); after != before+1 {
+				t.Errorf("Error: expected the denial to be counted, counter went from %v to %v", before, after)
+			}
+		})
+	}
+
+	var none *NamePolicy
+	if err := none.Check([]string{"anything.example.com"}); err != nil {
+		t.Errorf("Error: expected no policy to allow every name but got %v", err)
+	}
+	if err := (&NamePolicy{Deny: []string{"bad.example.com"}}).Check([]string{"good.example.com"}); err != nil {
+		t.Errorf("Error: expected a deny-only policy to allow other names but got %v", err)
+	}
+}
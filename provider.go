@@ -3,9 +3,14 @@ package acme
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
 )
 
 type RecordStore struct {
@@ -15,6 +20,116 @@ type RecordStore struct {
 type Provider struct {
 	sync.Mutex
 	recordMap map[string]*RecordStore
+	// journal persists the records so that they survive a restart
+	journal *OrderJournal
+	// serial is the SOA serial of the records, raised on every change
+	serial uint32
+	// history holds the latest changes, to answer IXFR queries with deltas
+	history []zoneChange
+	// notify is called with the new serial after every change
+	notify func(serial uint32)
+}
+
+// maxZoneChanges bounds the history of changes. Secondaries further behind
+// get the whole zone.
+const maxZoneChanges = 100
+
+// challengeRecord is a TXT record of a challenge name.
+type challengeRecord struct {
+	Zone  string
+	Value string
+}
+
+// zoneChange is a change of the records from one serial to the next.
+type zoneChange struct {
+	From    uint32
+	To      uint32
+	Deleted []challengeRecord
+	Added   []challengeRecord
+}
+
+func challengeRecords(zone string, recs []libdns.Record) []challengeRecord {
+	var records []challengeRecord
+	for _, rec := range recs {
+		records = append(records, challengeRecord{Zone: ownerName(zone, rec), Value: rec.Value})
+	}
+	return records
+}
+
+// ownerName returns the name rec, presented in zone, is at. DNS-01 solvers
+// present records in the zone whose SOA they find: the challenge name
+// itself, which answers SOA queries, unless the zone is signed. Names
+// ending in a dot are already fully qualified.
+func ownerName(zone string, rec libdns.Record) string {
+	if strings.HasSuffix(rec.Name, ".") {
+		return strings.ToLower(rec.Name)
+	}
+	return strings.ToLower(libdns.AbsoluteName(rec.Name, zone))
+}
+
+// Serial returns the SOA serial of the records. It is the time of the last
+// change in seconds since the epoch, or one more than the previous serial
+// when that is not larger, so it increases across restarts too.
+func (p *Provider) Serial() uint32 {
+	p.Lock()
+	defer p.Unlock()
+	if p.serial == 0 {
+		p.raiseSerial()
+	}
+	return p.serial
+}
+
+// raiseSerial raises the serial. The caller must hold the lock.
+func (p *Provider) raiseSerial() {
+	if now := uint32(time.Now().Unix()); now > p.serial {
+		p.serial = now
+	} else {
+		p.serial++
+	}
+}
+
+// changed raises the serial, keeps the change in the history and notifies
+// the secondaries. Changes made before the serial was first read are not
+// kept, as no secondary can have the zone from before them. The caller must
+// hold the lock.
+func (p *Provider) changed(deleted, added []challengeRecord) {
+	from := p.serial
+	p.raiseSerial()
+	if from != 0 {
+		p.history = append(p.history, zoneChange{From: from, To: p.serial, Deleted: deleted, Added: added})
+		if len(p.history) > maxZoneChanges {
+			p.history = p.history[len(p.history)-maxZoneChanges:]
+		}
+	}
+	if p.notify != nil {
+		go p.notify(p.serial)
+	}
+}
+
+// apexChanged raises the serial after the apex records changed. They are
+// not kept in the history, so it is dropped and secondaries transfer the
+// whole zone.
+func (p *Provider) apexChanged() {
+	p.Lock()
+	defer p.Unlock()
+	p.changed(nil, nil)
+	p.history = nil
+}
+
+// snapshot returns the serial, the records sorted by challenge name and the
+// changes leading to them, as of the same moment.
+func (p *Provider) snapshot() (uint32, []challengeRecord, []zoneChange) {
+	p.Lock()
+	defer p.Unlock()
+	if p.serial == 0 {
+		p.raiseSerial()
+	}
+	var records []challengeRecord
+	for zone, store := range p.recordMap {
+		records = append(records, challengeRecords(zone, store.entries)...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Zone < records[j].Zone })
+	return p.serial, records, append([]zoneChange(nil), p.history...)
 }
 
 func (p *Provider) getZoneRecords(ctx context.Context, zoneName string) *RecordStore {
@@ -31,14 +146,21 @@ func compareRecords(a, b libdns.Record) bool {
 
 func (r *RecordStore) deleteRecords(recs []libdns.Record) []libdns.Record {
 	deletedRecords := []libdns.Record{}
-	for i, entry := range r.entries {
+	kept := r.entries[:0]
+	for _, entry := range r.entries {
+		deleted := false
 		for _, record := range recs {
 			if compareRecords(entry, record) {
-				deletedRecords = append(deletedRecords, record)
-				r.entries = append(r.entries[:i], r.entries[i+1:]...)
+				deleted = true
 			}
 		}
+		if deleted {
+			deletedRecords = append(deletedRecords, entry)
+		} else {
+			kept = append(kept, entry)
+		}
 	}
+	r.entries = kept
 	return deletedRecords
 }
 func (p *Provider) AppendRecords(ctx context.Context, zoneName string, recs []libdns.Record) ([]libdns.Record, error) {
@@ -50,6 +172,12 @@ func (p *Provider) AppendRecords(ctx context.Context, zoneName string, recs []li
 		p.recordMap[zoneName] = zoneRecordStore
 	}
 	zoneRecordStore.entries = append(zoneRecordStore.entries, recs...)
+	p.changed(nil, challengeRecords(zoneName, recs))
+	if p.journal != nil {
+		if err := p.journal.addRecords(zoneName, recs); err != nil {
+			return nil, err
+		}
+	}
 	return zoneRecordStore.entries, nil
 }
 
@@ -61,6 +189,14 @@ func (p *Provider) DeleteRecords(ctx context.Context, zoneName string, recs []li
 		return nil, nil
 	}
 	deletedRecords := zoneRecordStore.deleteRecords(recs)
+	if len(deletedRecords) > 0 {
+		p.changed(challengeRecords(zoneName, deletedRecords), nil)
+	}
+	if p.journal != nil {
+		if err := p.journal.deleteRecords(zoneName, recs); err != nil {
+			return nil, err
+		}
+	}
 	return deletedRecords, nil
 }
 
@@ -74,6 +210,62 @@ func (p *Provider) GetRecords(ctx context.Context, zoneName string) ([]libdns.Re
 	return records.entries, nil
 }
 
+// hasNamesUnder reports whether records are held for name or a name below
+// it.
+func (p *Provider) hasNamesUnder(name string) bool {
+	p.Lock()
+	defer p.Unlock()
+	for zone, store := range p.recordMap {
+		for _, rec := range store.entries {
+			if dns.IsSubDomain(name, ownerName(zone, rec)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordsAt returns the records at name, in whichever zone they were
+// presented.
+func (p *Provider) recordsAt(name string) []libdns.Record {
+	p.Lock()
+	defer p.Unlock()
+	var records []libdns.Record
+	for zone, store := range p.recordMap {
+		for _, rec := range store.entries {
+			if ownerName(zone, rec) == name {
+				records = append(records, rec)
+			}
+		}
+	}
+	return records
+}
+
+// clearChallenge removes the DNS-01 challenge records presented for name,
+// returning how many were removed.
+func (p *Provider) clearChallenge(ctx context.Context, name string) int {
+	challenge := dnsChallengeString + strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(name, ".")), "*.") + "."
+	p.Lock()
+	presented := make(map[string][]libdns.Record)
+	for zone, store := range p.recordMap {
+		for _, rec := range store.entries {
+			if ownerName(zone, rec) == challenge {
+				presented[zone] = append(presented[zone], rec)
+			}
+		}
+	}
+	p.Unlock()
+	removed := 0
+	for zone, records := range presented {
+		deleted, err := p.DeleteRecords(ctx, zone, records)
+		if err != nil {
+			log.Warningf("removing challenge records for %s: %v", name, err)
+		}
+		removed += len(deleted)
+	}
+	return removed
+}
+
 var (
 	_ libdns.RecordGetter   = (*Provider)(nil)
 	_ libdns.RecordAppender = (*Provider)(nil)
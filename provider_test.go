@@ -71,3 +71,71 @@ func TestProviderAppendRecords(t *testing.T) {
 		}
 	}
 }
+
+func TestProviderSerial(t *testing.T) {
+	provider := Provider{
+		recordMap: make(map[string]*RecordStore),
+	}
+	ctx := context.Background()
+	serial := provider.Serial()
+	if serial < uint32(time.Now().Add(-time.Minute).Unix()) {
+		t.Fatalf("Error: expected a serial based on the current time but got %d", serial)
+	}
+	if provider.Serial() != serial {
+		t.Fatal("Error: expected the serial to stay the same without changes")
+	}
+	records := generateRandomRecords(2)
+	if _, err := provider.AppendRecords(ctx, "zone", records); err != nil {
+		t.Fatal(err)
+	}
+	appended := provider.Serial()
+	if appended <= serial {
+		t.Fatalf("Error: expected the serial to increase after appending, got %d then %d", serial, appended)
+	}
+	if _, err := provider.DeleteRecords(ctx, "zone", generateRandomRecords(1)); err != nil {
+		t.Fatal(err)
+	}
+	if provider.Serial() != appended {
+		t.Fatal("Error: expected the serial to stay the same when nothing was deleted")
+	}
+	if _, err := provider.DeleteRecords(ctx, "zone", records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := provider.Serial(); deleted <= appended {
+		t.Fatalf("Error: expected the serial to increase after deleting, got %d then %d", appended, deleted)
+	}
+}
+
+func TestProviderHistory(t *testing.T) {
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	ctx := context.Background()
+	zone := "_acme-challenge.test.domain."
+	notified := make(chan uint32, 3)
+	provider.notify = func(serial uint32) { notified <- serial }
+	// changes before the serial is read are not kept
+	if _, err := provider.AppendRecords(ctx, zone, []libdns.Record{{Type: "TXT", Name: zone, Value: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	serial := provider.Serial()
+	if _, err := provider.AppendRecords(ctx, zone, []libdns.Record{{Type: "TXT", Name: zone, Value: "second"}}); err != nil {
+		t.Fatal(err)
+	}
+	current, records, history := provider.snapshot()
+	if len(records) != 2 || records[0].Zone != zone {
+		t.Fatalf("Error: expected both records but got %v", records)
+	}
+	if len(history) != 1 || history[0].From != serial || history[0].To != current || len(history[0].Added) != 1 || history[0].Added[0].Value != "second" {
+		t.Fatalf("Error: expected the second record to be added from serial %d to %d but got %+v", serial, current, history)
+	}
+	provider.apexChanged()
+	if _, _, history := provider.snapshot(); len(history) != 0 {
+		t.Errorf("Error: expected the history to be dropped when the apex changes but got %+v", history)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Fatalf("Error: expected a notification for each of the 3 changes but got %d", i)
+		}
+	}
+}
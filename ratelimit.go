@@ -0,0 +1,317 @@
+package acme
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez/acme"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	OrderEvent            = "orders"
+	DuplicateEvent        = "duplicates"
+	FailedValidationEvent = "failed_validations"
+	AccountEvent          = "accounts"
+)
+
+// RateLimit allows at most Limit events within any Window. A zero Limit
+// disables the limit.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// defaultRateLimits mirror the Let's Encrypt limits that a single plugin
+// instance can realistically hit: certificates per registered domain,
+// duplicate certificates for the same set of names, failed validations and
+// new accounts.
+func defaultRateLimits() map[string]RateLimit {
+	return map[string]RateLimit{
+		OrderEvent:            {Limit: 50, Window: 7 * 24 * time.Hour},
+		DuplicateEvent:        {Limit: 5, Window: 7 * 24 * time.Hour},
+		FailedValidationEvent: {Limit: 5, Window: time.Hour},
+		AccountEvent:          {Limit: 10, Window: 3 * time.Hour},
+	}
+}
+
+// RateLimitError is returned when an order or account registration would
+// cross a local rate limit.
+type RateLimitError struct {
+	Event      string
+	Domain     string
+	Limit      RateLimit
+	RetryAfter time.Time
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("local rate limit of %d %s per %s reached for %s; next attempt possible at %s",
+		e.Limit.Limit, e.Event, e.Limit.Window, e.Domain, e.RetryAfter.UTC().Format(time.RFC3339))
+}
+
+// Ledger keeps a persistent record of ACME events per registered domain,
+// and of duplicate orders per set of names, in certmagic storage, so that
+// limits hold across restarts and replicas sharing the same storage.
+type Ledger struct {
+	Storage certmagic.Storage
+	Limits  map[string]RateLimit
+}
+
+type ledgerRecord map[string][]time.Time
+
+func registeredDomain(name string) string {
+	if net.ParseIP(name) != nil {
+		return name
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	name = strings.TrimPrefix(name, "*.")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// registeredDomains returns the distinct registered domains of names,
+// leaving out IP addresses.
+func registeredDomains(names []string) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			continue
+		}
+		domain := registeredDomain(name)
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// nameSet returns the sorted, lower case names of an order, which Let's
+// Encrypt counts duplicate certificates by.
+func nameSet(names []string) []string {
+	set := make([]string, 0, len(names))
+	for _, name := range names {
+		set = append(set, strings.TrimSuffix(strings.ToLower(name), "."))
+	}
+	sort.Strings(set)
+	return set
+}
+
+func ledgerKey(domain string) string {
+	return path.Join(storagePrefix, "ledger", domain+".json")
+}
+
+// nameSetKey is the ledger key of the duplicate orders for a set of names.
+func nameSetKey(set []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(set, ",")))
+	return path.Join(storagePrefix, "ledger", "names", hex.EncodeToString(sum[:])+".json")
+}
+
+func (l *Ledger) update(ctx context.Context, key string, f func(ledgerRecord) error) error {
+	if err := l.Storage.Lock(ctx, key); err != nil {
+		return err
+	}
+	defer l.Storage.Unlock(key)
+
+	record := ledgerRecord{}
+	data, err := l.Storage.Load(key)
+	if err == nil {
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("decoding ledger %s: %v", key, err)
+		}
+	} else if _, ok := err.(certmagic.ErrNotExist); !ok {
+		return err
+	}
+	if err := f(record); err != nil {
+		return err
+	}
+	data, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return l.Storage.Store(key, data)
+}
+
+// prune drops the events that fall outside the window of their limit.
+func (l *Ledger) prune(record ledgerRecord, now time.Time) {
+	for event, times := range record {
+		window := l.Limits[event].Window
+		kept := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < window {
+				kept = append(kept, t)
+			}
+		}
+		record[event] = kept
+	}
+}
+
+func (l *Ledger) check(record ledgerRecord, event, domain string, now time.Time) error {
+	limit := l.Limits[event]
+	if limit.Limit <= 0 {
+		return nil
+	}
+	times := record[event]
+	if len(times) < limit.Limit {
+		return nil
+	}
+	return RateLimitError{
+		Event:      event,
+		Domain:     domain,
+		Limit:      limit,
+		RetryAfter: times[len(times)-limit.Limit].Add(limit.Window),
+	}
+}
+
+// Reserve records event for the registered domain of name, unless doing so
+// would cross its limit or any of the blocking events are already at
+// theirs.
+func (l *Ledger) Reserve(ctx context.Context, event, name string, blocking ...string) error {
+	domain := registeredDomain(name)
+	return l.update(ctx, ledgerKey(domain), func(record ledgerRecord) error {
+		now := time.Now()
+		l.prune(record, now)
+		for _, e := range append(blocking, event) {
+			if err := l.check(record, e, domain, now); err != nil {
+				return err
+			}
+		}
+		record[event] = append(record[event], now)
+		return nil
+	})
+}
+
+// Record unconditionally records event for the registered domain of name.
+func (l *Ledger) Record(ctx context.Context, event, name string) error {
+	return l.update(ctx, ledgerKey(registeredDomain(name)), func(record ledgerRecord) error {
+		now := time.Now()
+		l.prune(record, now)
+		record[event] = append(record[event], now)
+		return nil
+	})
+}
+
+// ReserveOrder records an order for names, unless it would cross the limit
+// of duplicate orders for exactly these names, the limit of orders for any
+// of their registered domains, or failed validations are at their limit.
+// The order is charged to each registered domain once, IP addresses have
+// none. Events are only recorded once the order is reserved, so that
+// refused orders are not counted.
+func (l *Ledger) ReserveOrder(ctx context.Context, names []string) error {
+	set := nameSet(names)
+	if len(set) == 0 {
+		return errors.New("no names to order")
+	}
+	key := nameSetKey(set)
+	err := l.update(ctx, key, func(record ledgerRecord) error {
+		now := time.Now()
+		l.prune(record, now)
+		return l.check(record, DuplicateEvent, strings.Join(set, ","), now)
+	})
+	if err != nil {
+		return err
+	}
+	domains := registeredDomains(set)
+	for _, domain := range domains {
+		err := l.update(ctx, ledgerKey(domain), func(record ledgerRecord) error {
+			now := time.Now()
+			l.prune(record, now)
+			for _, event := range []string{FailedValidationEvent, OrderEvent} {
+				if err := l.check(record, event, domain, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, domain := range domains {
+		if err := l.Record(ctx, OrderEvent, domain); err != nil {
+			return err
+		}
+	}
+	return l.update(ctx, key, func(record ledgerRecord) error {
+		record[DuplicateEvent] = append(record[DuplicateEvent], time.Now())
+		return nil
+	})
+}
+
+// Usage returns how many times each event happened within its window.
+func (l *Ledger) Usage(name string) (map[string]int, error) {
+	data, err := l.Storage.Load(ledgerKey(registeredDomain(name)))
+	if _, ok := err.(certmagic.ErrNotExist); ok {
+		return map[string]int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := ledgerRecord{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	l.prune(record, time.Now())
+	usage := map[string]int{}
+	for event, times := range record {
+		usage[event] = len(times)
+	}
+	return usage, nil
+}
+
+func isValidationFailure(err error) bool {
+	var problem acme.Problem
+	if !errors.As(err, &problem) {
+		return false
+	}
+	if _, ok := problem.Resource.(acme.Authorization); ok {
+		return true
+	}
+	switch problem.Type {
+	case acme.ProblemTypeUnauthorized,
+		acme.ProblemTypeIncorrectResponse,
+		acme.ProblemTypeDNS,
+		acme.ProblemTypeConnection,
+		acme.ProblemTypeTLS,
+		acme.ProblemTypeCAA:
+		return true
+	}
+	return false
+}
+
+// csrNames returns the DNS names and IP addresses of csr.
+func csrNames(csr *x509.CertificateRequest) []string {
+	names := append([]string(nil), csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && csr.Subject.CommonName != "" {
+		names = append(names, csr.Subject.CommonName)
+	}
+	return names
+}
+
+func csrName(csr *x509.CertificateRequest) string {
+	if len(csr.DNSNames) > 0 {
+		return csr.DNSNames[0]
+	}
+	if len(csr.IPAddresses) > 0 {
+		return csr.IPAddresses[0].String()
+	}
+	return csr.Subject.CommonName
+}
@@ -0,0 +1,122 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestLedgerReserve(t *testing.T) {
+	ctx := context.Background()
+	limits := map[string]RateLimit{
+		OrderEvent:            {Limit: 2, Window: time.Hour},
+		FailedValidationEvent: {Limit: 1, Window: time.Hour},
+		AccountEvent:          {Limit: 0, Window: time.Hour},
+	}
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ledger := &Ledger{Storage: storage, Limits: limits}
+
+	for i := 0; i < 2; i++ {
+		if err := ledger.Reserve(ctx, OrderEvent, "a.example.com"); err != nil {
+			t.Fatalf("Error: order %d refused: %v", i, err)
+		}
+	}
+	// a new ledger on the same storage sees the orders of the previous one
+	restarted := &Ledger{Storage: storage, Limits: limits}
+	err := restarted.Reserve(ctx, OrderEvent, "b.example.com")
+	var rateLimitErr RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("Error: expected a RateLimitError but got %v", err)
+	}
+	if rateLimitErr.Domain != "example.com" {
+		t.Errorf("Error: expected registered domain example.com but got %s", rateLimitErr.Domain)
+	}
+	if until := time.Until(rateLimitErr.RetryAfter); until <= 0 || until > time.Hour {
+		t.Errorf("Error: unexpected retry time %s", rateLimitErr.RetryAfter)
+	}
+
+	if err := ledger.Reserve(ctx, OrderEvent, "example.org"); err != nil {
+		t.Errorf("Error: order for another registered domain refused: %v", err)
+	}
+	if err := ledger.Record(ctx, FailedValidationEvent, "example.org"); err != nil {
+		t.Fatalf("Error: recording failed validation: %v", err)
+	}
+	if err := ledger.Reserve(ctx, OrderEvent, "example.org", FailedValidationEvent); err == nil {
+		t.Errorf("Error: expected order to be refused after failed validations")
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := ledger.Reserve(ctx, AccountEvent, "example.com"); err != nil {
+			t.Errorf("Error: disabled limit refused account: %v", err)
+		}
+	}
+	usage, err := ledger.Usage("example.com")
+	if err != nil {
+		t.Fatalf("Error: reading usage: %v", err)
+	}
+	if usage[OrderEvent] != 2 || usage[AccountEvent] != 5 {
+		t.Errorf("Error: unexpected usage %+v", usage)
+	}
+}
+
+func TestLedgerReserveOrder(t *testing.T) {
+	ctx := context.Background()
+	limits := map[string]RateLimit{
+		OrderEvent:            {Limit: 3, Window: time.Hour},
+		DuplicateEvent:        {Limit: 2, Window: time.Hour},
+		FailedValidationEvent: {Limit: 1, Window: time.Hour},
+	}
+	ledger := &Ledger{Storage: &certmagic.FileStorage{Path: t.TempDir()}, Limits: limits}
+
+	for i := 0; i < 2; i++ {
+		// the same set of names in another order and case is a duplicate
+		names := []string{"example.com", "WWW.example.com"}
+		if i == 1 {
+			names = []string{"www.example.com.", "example.com"}
+		}
+		if err := ledger.ReserveOrder(ctx, names); err != nil {
+			t.Fatalf("Error: order %d refused: %v", i, err)
+		}
+	}
+	err := ledger.ReserveOrder(ctx, []string{"example.com", "www.example.com"})
+	var rateLimitErr RateLimitError
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.Event != DuplicateEvent {
+		t.Fatalf("Error: expected the duplicate limit to be reached but got %v", err)
+	}
+	// other names under the same registered domain are not duplicates
+	if err := ledger.ReserveOrder(ctx, []string{"api.example.com"}); err != nil {
+		t.Fatalf("Error: order for other names refused: %v", err)
+	}
+	err = ledger.ReserveOrder(ctx, []string{"mail.example.com"})
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.Event != OrderEvent || rateLimitErr.Domain != "example.com" {
+		t.Fatalf("Error: expected the registered domain limit to be reached but got %v", err)
+	}
+	// orders are charged to each of their registered domains, not to their
+	// IP addresses
+	if err := ledger.ReserveOrder(ctx, []string{"192.0.2.1", "example.org", "www.example.net"}); err != nil {
+		t.Fatalf("Error: order for other registered domains refused: %v", err)
+	}
+	for name, want := range map[string]int{"example.org": 1, "example.net": 1, "192.0.2.1": 0} {
+		if usage, err := ledger.Usage(name); err != nil || usage[OrderEvent] != want {
+			t.Errorf("Error: expected %d orders for %s but got %v (%v)", want, name, usage, err)
+		}
+	}
+	// an order refused for one registered domain is not charged to the
+	// others
+	err = ledger.ReserveOrder(ctx, []string{"example.org", "shop.example.com"})
+	if !errors.As(err, &rateLimitErr) || rateLimitErr.Domain != "example.com" {
+		t.Fatalf("Error: expected the limit of example.com to be reached but got %v", err)
+	}
+	if usage, err := ledger.Usage("example.org"); err != nil || usage[OrderEvent] != 1 {
+		t.Errorf("Error: expected the refused order not to be charged to example.org but got %v (%v)", usage, err)
+	}
+	// the order refused by the registered domain limit is not counted as a
+	// duplicate
+	ledger.Limits = map[string]RateLimit{DuplicateEvent: {Limit: 1, Window: time.Hour}}
+	if err := ledger.ReserveOrder(ctx, []string{"mail.example.com"}); err != nil {
+		t.Errorf("Error: expected the refused order not to count as a duplicate but got %v", err)
+	}
+}
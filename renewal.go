@@ -0,0 +1,177 @@
+package acme
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// MaintenanceWindow is a daily span of time in UTC, stored as offsets
+// from midnight. A window whose End is before its Start wraps past midnight.
+type MaintenanceWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// RenewalPolicy decides when a certificate should be renewed. Before takes
+// precedence over Ratio when both are set.
+type RenewalPolicy struct {
+	Before  time.Duration
+	Ratio   float64
+	Jitter  time.Duration
+	Windows []MaintenanceWindow
+
+	// offset is drawn once per process from [0, Jitter) so that replicas
+	// sharing a certificate do not all renew at the same moment.
+	offset time.Duration
+}
+
+// shortLivedLifetime is the longest validity for which a certificate is
+// treated as short-lived: the CA/Browser Forum lets certificates valid for
+// up to 7 days omit revocation information.
+const shortLivedLifetime = 10 * 24 * time.Hour
+
+func isShortLived(notBefore, notAfter time.Time) bool {
+	return notAfter.Sub(notBefore) <= shortLivedLifetime
+}
+
+func newRenewalPolicy(p RenewalPolicy) RenewalPolicy {
+	if p.Jitter > 0 {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		p.offset = time.Duration(r.Int63n(int64(p.Jitter)))
+	}
+	return p
+}
+
+// renewalWindow adapts the policy to the certificate's lifetime, so that a
+// policy written for 90-day certificates still works for short-lived ones.
+func (p RenewalPolicy) renewalWindow(notBefore, notAfter time.Time) time.Duration {
+	lifetime := notAfter.Sub(notBefore)
+	window := p.Before
+	if window >= lifetime {
+		window = lifetime / 2
+	}
+	if window == 0 {
+		ratio := p.Ratio
+		if ratio == 0 {
+			ratio = certmagic.DefaultRenewalWindowRatio
+			if isShortLived(notBefore, notAfter) {
+				ratio = 0.5
+			}
+		}
+		window = time.Duration(float64(lifetime) * ratio)
+	}
+	offset := p.offset
+	if offset > lifetime/10 {
+		offset = lifetime / 10
+	}
+	return window + offset
+}
+
+// NextRenewal returns the earliest time at or after now at which a
+// certificate valid from notBefore to notAfter should be renewed.
+func (p RenewalPolicy) NextRenewal(notBefore, notAfter, now time.Time) time.Time {
+	due := notAfter.Add(-p.renewalWindow(notBefore, notAfter))
+	if due.Before(now) {
+		due = now
+	}
+	next := p.nextWindow(due)
+	// never let a maintenance window hold a renewal past expiry
+	if !next.Before(notAfter) {
+		return due
+	}
+	return next
+}
+
+// nextWindow returns t if it falls inside a maintenance window, otherwise
+// the start of the next window.
+func (p RenewalPolicy) nextWindow(t time.Time) time.Time {
+	if len(p.Windows) == 0 {
+		return t
+	}
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := t.Sub(midnight)
+	var next time.Time
+	for _, w := range p.Windows {
+		if w.contains(offset) {
+			return t
+		}
+		start := midnight.Add(w.Start)
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+func (w MaintenanceWindow) contains(offset time.Duration) bool {
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// windowRatio translates the policy into the ratio certmagic uses for its
+// renewal checks, so that a certificate enters certmagic's renewal window
+// exactly at its scheduled renewal time.
+func (p RenewalPolicy) windowRatio(notBefore, notAfter, now time.Time) float64 {
+	lifetime := notAfter.Sub(notBefore)
+	if lifetime <= 0 {
+		return certmagic.DefaultRenewalWindowRatio
+	}
+	ratio := float64(notAfter.Sub(p.NextRenewal(notBefore, notAfter, now))) / float64(lifetime)
+	if ratio <= 0 {
+		// certmagic treats 0 as "use the default"
+		return 1e-9
+	}
+	if ratio > 1 {
+		return 1
+	}
+	return ratio
+}
+
+func parseRenewBefore(arg string) (time.Duration, float64, error) {
+	if strings.HasSuffix(arg, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return 0, 0, fmt.Errorf("invalid percentage %s", arg)
+		}
+		return 0, percent / 100, nil
+	}
+	before, err := time.ParseDuration(arg)
+	if err != nil || before <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration %s", arg)
+	}
+	return before, 0, nil
+}
+
+func parseMaintenanceWindow(start, end string) (MaintenanceWindow, error) {
+	s, err := parseClock(start)
+	if err != nil {
+		return MaintenanceWindow{}, err
+	}
+	e, err := parseClock(end)
+	if err != nil {
+		return MaintenanceWindow{}, err
+	}
+	if s == e {
+		return MaintenanceWindow{}, fmt.Errorf("maintenance window %s-%s is empty", start, end)
+	}
+	return MaintenanceWindow{Start: s, End: e}, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s: expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
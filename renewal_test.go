@@ -0,0 +1,142 @@
+package acme
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRenewal(t *testing.T) {
+	notBefore := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * 24 * time.Hour)
+	tests := []struct {
+		name     string
+		policy   RenewalPolicy
+		now      time.Time
+		expected time.Time
+	}{
+		{
+			"Default ratio",
+			RenewalPolicy{},
+			notBefore,
+			notBefore.Add(60 * 24 * time.Hour),
+		},
+		{
+			"Renew before duration",
+			RenewalPolicy{Before: 10 * 24 * time.Hour},
+			notBefore,
+			notAfter.Add(-10 * 24 * time.Hour),
+		},
+		{
+			"Renew before percentage",
+			RenewalPolicy{Ratio: 0.5},
+			notBefore,
+			notBefore.Add(45 * 24 * time.Hour),
+		},
+		{
+			"Overdue renewal happens now",
+			RenewalPolicy{},
+			notAfter.Add(-time.Hour),
+			notAfter.Add(-time.Hour),
+		},
+		{
+			"Renewal moved into maintenance window",
+			RenewalPolicy{Before: 10*24*time.Hour + 12*time.Hour, Windows: []MaintenanceWindow{{Start: 2 * time.Hour, End: 5 * time.Hour}}},
+			notBefore,
+			time.Date(2021, 8, 20, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			"Renewal inside wrapping maintenance window",
+			RenewalPolicy{Before: 10*24*time.Hour + time.Hour, Windows: []MaintenanceWindow{{Start: 22 * time.Hour, End: 2 * time.Hour}}},
+			notBefore,
+			time.Date(2021, 8, 19, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			"Maintenance window never delays renewal past expiry",
+			RenewalPolicy{Windows: []MaintenanceWindow{{Start: 2 * time.Hour, End: 3 * time.Hour}}},
+			notAfter.Add(-time.Hour),
+			notAfter.Add(-time.Hour),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := test.policy.NextRenewal(notBefore, notAfter, test.now)
+			if !next.Equal(test.expected) {
+				t.Errorf("Error: expected next renewal at %s but got %s", test.expected, next)
+			}
+		})
+	}
+}
+
+func TestRenewalJitter(t *testing.T) {
+	notBefore := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * 24 * time.Hour)
+	policy := newRenewalPolicy(RenewalPolicy{Before: 30 * 24 * time.Hour, Jitter: 6 * time.Hour})
+	next := policy.NextRenewal(notBefore, notAfter, notBefore)
+	latest := notAfter.Add(-30 * 24 * time.Hour)
+	if next.After(latest) || !next.After(latest.Add(-6*time.Hour)) {
+		t.Errorf("Error: next renewal %s is outside the jitter range before %s", next, latest)
+	}
+	ratio := policy.windowRatio(notBefore, notAfter, notBefore)
+	if expected := float64(notAfter.Sub(next)) / float64(notAfter.Sub(notBefore)); ratio != expected {
+		t.Errorf("Error: expected renewal window ratio %v but got %v", expected, ratio)
+	}
+}
+
+func TestShortLivedRenewal(t *testing.T) {
+	notBefore := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(160 * time.Hour)
+	tests := []struct {
+		name     string
+		policy   RenewalPolicy
+		expected time.Time
+	}{
+		{
+			"Default renews at half the lifetime",
+			RenewalPolicy{},
+			notBefore.Add(80 * time.Hour),
+		},
+		{
+			"Renew before longer than the lifetime",
+			RenewalPolicy{Before: 720 * time.Hour},
+			notBefore.Add(80 * time.Hour),
+		},
+		{
+			"Explicit percentage is kept",
+			RenewalPolicy{Ratio: 0.25},
+			notBefore.Add(120 * time.Hour),
+		},
+		{
+			"Jitter is capped at a tenth of the lifetime",
+			RenewalPolicy{Before: 40 * time.Hour, offset: 48 * time.Hour},
+			notBefore.Add(104 * time.Hour),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := test.policy.NextRenewal(notBefore, notAfter, notBefore)
+			if !next.Equal(test.expected) {
+				t.Errorf("Error: expected next renewal at %s but got %s", test.expected, next)
+			}
+		})
+	}
+}
+
+func TestIsShortLived(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		expected bool
+	}{
+		{"Six days", 160 * time.Hour, true},
+		{"Ten days", shortLivedLifetime, true},
+		{"Ninety days", 90 * 24 * time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isShortLived(now, now.Add(test.lifetime)); got != test.expected {
+				t.Errorf("Error: isShortLived for %s = %v, expected %v", test.lifetime, got, test.expected)
+			}
+		})
+	}
+}
@@ -1,86 +1,322 @@
 package acme
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
 )
 
 const pluginName = "acme"
 
+// approvalPollInterval is how often a pending approval is looked up in
+// storage while startup waits for it.
+var approvalPollInterval = time.Minute
+
 func init() {
 	plugin.Register(pluginName, setup)
 }
 
 func setup(c *caddy.Controller) error {
-	acmeTemplate, zoneName, err := parseACME(c)
+	opts, err := parseACME(c)
 	provider := Provider{
 		recordMap: make(map[string]*RecordStore),
 	}
 	if err != nil {
 		return plugin.Error(pluginName, err)
 	}
+	zoneName := opts.zone
 	config := dnsserver.GetConfig(c)
 	acmeConfig := AcmeConfig{
 		Zone: zoneName,
+		CAA:  opts.caa,
+		SOA:  opts.soa,
+		TTL:  opts.ttl,
+	}
+	if opts.dnssec != nil {
+		opts.dnssec.Storage = newStorage(opts)
+		if err := opts.dnssec.load(context.Background()); err != nil {
+			return plugin.Error(pluginName, err)
+		}
+		acmeConfig.Signer = opts.dnssec
+	}
+	if opts.transfer != nil {
+		acmeConfig.Transfer = opts.transfer
+		zone := dns.Fqdn(strings.ToLower(zoneName))
+		provider.notify = func(serial uint32) {
+			opts.transfer.notify(zone, serial)
+		}
 	}
 	acmeHandler := &AcmeHandler{
 		provider:   &provider,
 		AcmeConfig: &acmeConfig,
+		Fall:       opts.fall,
+	}
+	// the server reads the TLS config when it starts, before any certificate
+	// can be issued, so it serves a temporary one until configureTLS swaps
+	// the managed certificates in. That only happens on the first startup,
+	// reloaded servers share the swapped certificates.
+	tlsConfig, certs, err := newTemporaryTLSConfig(zoneName, opts.ips)
+	if err != nil {
+		return plugin.Error(pluginName, err)
 	}
+	config.TLSConfig = tlsConfig
 	config.AddPlugin(func(next plugin.Handler) plugin.Handler {
 		acmeHandler.Next = next
 		return acmeHandler
 	})
-	c.OnFirstStartup(func() error {
-		go func() error {
-			authoritativeNameservers, err := getAuthoritativeNameServers(zoneName)
+	if opts.waitForCert > 0 {
+		// shared with reloaded servers, like the certificates
+		acmeHandler.certReady = certs.ready
+	}
+	if opts.approvalAddress != "" {
+		opts.approvals = &ApprovalQueue{Storage: newStorage(opts), Policy: opts.policy}
+		if opts.approvalTokens != "" {
+			opts.approvals.Tokens, err = readApprovalTokens(opts.approvalTokens)
 			if err != nil {
-				return err
+				return plugin.Error(pluginName, err)
 			}
-			authoritativeNameserver := authoritativeNameservers[len(authoritativeNameservers)-1]
-
-			ipAddr, err := getExternalIpAddress(authoritativeNameserver)
+		}
+		var approvalTLS *tls.Config
+		if opts.approvalClientCA != "" {
+			caPEM, err := ioutil.ReadFile(opts.approvalClientCA)
 			if err != nil {
-				log.Error(err)
-				return err
+				return plugin.Error(pluginName, err)
 			}
-			acmeHandler.Ipv4Addr = net.ParseIP(ipAddr).To4()
-			acmeHandler.Ipv6Addr = net.ParseIP(ipAddr).To16()
-			acmeHandler.AuthoritativeNameserver = authoritativeNameserver
+			opts.approvals.ClientCAs = x509.NewCertPool()
+			if !opts.approvals.ClientCAs.AppendCertsFromPEM(caPEM) {
+				return plugin.Error(pluginName, fmt.Errorf("%s holds no PEM certificates", opts.approvalClientCA))
+			}
+			approvalTLS = &tls.Config{
+				ClientAuth: tls.RequireAndVerifyClientCert,
+				ClientCAs:  opts.approvals.ClientCAs,
+			}
+		} else if !isLoopbackAddress(opts.approvalAddress) {
+			// bearer tokens must not cross the network in cleartext
+			approvalTLS = &tls.Config{}
+		}
+		if approvalTLS != nil {
+			// the endpoint serves the zone's certificate, temporary until
+			// it is issued, as approving may be what issuance waits for
+			approvalTLS.GetCertificate = certs.GetCertificate
+			setTLSDefaults(approvalTLS)
+		}
+		server := &http.Server{Addr: opts.approvalAddress, Handler: opts.approvals}
+		c.OnStartup(func() error {
+			ln, err := net.Listen("tcp", opts.approvalAddress)
+			if err != nil {
+				return plugin.Error(pluginName, err)
+			}
+			if approvalTLS != nil {
+				ln = tls.NewListener(ln, approvalTLS)
+			}
+			go server.Serve(ln)
+			log.Infof("Serving approvals for %s on %s", zoneName, opts.approvalAddress)
+			return nil
+		})
+		c.OnShutdown(func() error {
+			return server.Close()
+		})
+	}
+	c.OnFirstStartup(func() error {
+		issue := func() error {
+			var journal *OrderJournal
+			addresses, nameservers, err := discoverNameserver(zoneName, opts.addresses, opts.nameservers)
+			if err != nil {
+				log.Error(err)
+				// the internal issuer needs no public DNS, which air-gapped
+				// deployments do not have
+				if opts.issuer != InternalIssuer {
+					return err
+				}
+			} else {
+				acmeHandler.setAddresses(addresses)
+				acmeHandler.Nameservers = nameservers
+				acmeHandler.AuthoritativeNameserver = nameservers[len(nameservers)-1].Name
+				provider.apexChanged()
 
-			acmeTemplate.DNS01Solver = &certmagic.DNS01Solver{
-				DNSProvider: &provider,
-				Resolvers:   []string{ipAddr},
+				// challenges presented before a restart may still be
+				// validated by the CA, and their orders are resumed
+				journal = &OrderJournal{Storage: newStorage(opts), Zone: zoneName}
+				pending, err := journal.Restore(&provider)
+				if err != nil {
+					log.Warningf("Restoring pending challenges for %s: %v", zoneName, err)
+				}
+				for _, chal := range pending {
+					log.Infof("Resuming %s challenge %s for %s", chal.Type, chal.URL, chal.Identifier.Value)
+				}
+				provider.Lock()
+				provider.journal = journal
+				provider.Unlock()
+				opts.template.DNS01Solver = journalingSolver{
+					Solver: &certmagic.DNS01Solver{
+						DNSProvider: &provider,
+						Resolvers:   propagationResolvers(addresses),
+					},
+					journal: journal,
+				}
 			}
 
-			A := NewACME(acmeTemplate, zoneName)
-			err = A.IssueCert([]string{zoneName})
+			opts.provider = &provider
+			A := NewACME(opts)
+			if journal != nil && A.InternalCA == nil {
+				go A.WatchRestored(journal, &provider)
+			}
+			if A.InternalCA != nil && opts.rootPath != "" {
+				err = A.ExportRoot(opts.rootPath)
+				if err != nil {
+					log.Error(err)
+					return err
+				}
+				log.Infof("Internal CA root exported to %s", opts.rootPath)
+			}
+			if len(A.IPs) > 0 && A.InternalCA == nil {
+				err = A.OnStartup()
+				if err != nil {
+					log.Error(err)
+					return err
+				}
+			}
+			err = A.IssueCert(append([]string{zoneName}, A.IPs...))
+			var approvalErr ApprovalError
+			for errors.As(err, &approvalErr) && approvalErr.Status == ApprovalPending {
+				log.Infof("Waiting for the certificate for %s to be approved", approvalErr.Name)
+				// a decision made through another replica is only seen in
+				// storage
+				select {
+				case <-opts.approvals.decided(approvalErr.Name):
+				case <-time.After(approvalPollInterval):
+				}
+				err = A.IssueCert(append([]string{zoneName}, A.IPs...))
+			}
 			if err != nil {
 				log.Error(err)
 				return err
 			}
 			log.Info("Certificate Issued")
-			err = configureTLS(A, zoneName, config)
+			if opts.caa.Auto && A.InternalCA == nil {
+				if account, err := A.Account(context.Background()); err != nil {
+					log.Warningf("Binding the CAA records of %s to the ACME account: %v", zoneName, err)
+				} else {
+					opts.caa.bindAccount(account.Location)
+					provider.apexChanged()
+				}
+			}
+			err = configureTLS(A, zoneName, certs)
 			if err != nil {
 				log.Error(err)
 				return err
 			}
-			log.Info("TLS Configured")
+			log.Infof("TLS Configured, temporary certificate for %s replaced", zoneName)
+			if next, err := A.NextRenewal(zoneName); err == nil {
+				log.Infof("Next renewal for %s scheduled at %s", zoneName, next.UTC().Format(time.RFC3339))
+			}
 			return nil
+		}
+		result := make(chan error, 1)
+		go func() {
+			result <- issue()
 		}()
+		if opts.waitForCert == 0 {
+			return nil
+		}
+		log.Infof("Waiting up to %s for the certificate for %s", opts.waitForCert, zoneName)
+		select {
+		case err := <-result:
+			if err != nil && opts.waitFail {
+				return plugin.Error(pluginName, err)
+			}
+		case <-time.After(opts.waitForCert):
+			if opts.waitFail {
+				return plugin.Error(pluginName, fmt.Errorf("no certificate for %s after %s", zoneName, opts.waitForCert))
+			}
+			log.Warningf("No certificate for %s after %s, starting with the temporary certificate", zoneName, opts.waitForCert)
+		}
 		return nil
 	})
 	return nil
 }
 
+// discoverNameserver returns the addresses of this server and the NS set of
+// the zone. The NS set is the configured one, or else the zone's
+// authoritative nameservers, with the addresses of those inside the zone
+// looked up for glue. The addresses are the configured ones, or else the
+// external IPv4 and IPv6 addresses of the last nameserver.
+func discoverNameserver(zoneName string, addresses []net.IP, nameservers []Nameserver) ([]net.IP, []Nameserver, error) {
+	if len(nameservers) == 0 {
+		authoritativeNameservers, err := getAuthoritativeNameServers(zoneName)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range authoritativeNameservers {
+			ns := Nameserver{Name: name}
+			if dns.IsSubDomain(dns.Fqdn(strings.ToLower(zoneName)), name) {
+				ns.Addresses, err = getExternalIpAddresses(name)
+				if err != nil {
+					log.Warningf("No glue for nameserver %s: %v", name, err)
+				}
+			}
+			nameservers = append(nameservers, ns)
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses, nameservers, nil
+	}
+	authoritativeNameserver := nameservers[len(nameservers)-1]
+	if len(authoritativeNameserver.Addresses) > 0 {
+		return authoritativeNameserver.Addresses, nameservers, nil
+	}
+	addresses, err := getExternalIpAddresses(authoritativeNameserver.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addresses, nameservers, nil
+}
+
+// isLoopbackAddress reports whether the host of address, a host and port,
+// is a loopback address.
+func isLoopbackAddress(address string) bool {
+	host, _, _ := net.SplitHostPort(address)
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// propagationResolvers returns the apex addresses as the resolvers the
+// propagation of challenge records is checked with, IPv4 addresses first.
+func propagationResolvers(addresses []net.IP) []string {
+	var v4, v6 []string
+	for _, ip := range addresses {
+		resolver := net.JoinHostPort(ip.String(), "53")
+		if ip.To4() != nil {
+			v4 = append(v4, resolver)
+		} else {
+			v6 = append(v6, resolver)
+		}
+	}
+	return append(v4, v6...)
+}
+
 func setTLSDefaults(tlsConfig *tls.Config) {
 	tlsConfig.MinVersion = tls.VersionTLS12
 	tlsConfig.MaxVersion = tls.VersionTLS13
@@ -98,13 +334,60 @@ func setTLSDefaults(tlsConfig *tls.Config) {
 	tlsConfig.PreferServerCipherSuites = true
 }
 
-func parseACME(c *caddy.Controller) (certmagic.ACMEManager, string, error) {
-	acmeTemplate := certmagic.ACMEManager{
-		Agreed:                  true,
-		DisableHTTPChallenge:    true,
-		DisableTLSALPNChallenge: true,
+type acmeOptions struct {
+	template   certmagic.ACMEManager
+	zone       string
+	renewal    RenewalPolicy
+	rateLimits map[string]RateLimit
+	onDemand   *OnDemandPolicy
+	policy     *NamePolicy
+	caa        *CAAPolicy
+	soa        SOAConfig
+	ttl        TTLConfig
+	fall       fall.F
+	ips        []string
+	issuer     string
+	// leafLifetime and rootPath only apply to the internal issuer
+	leafLifetime time.Duration
+	rootPath     string
+	// waitForCert holds startup back until the certificate is ready, and
+	// waitFail fails startup rather than continuing when it is not
+	waitForCert time.Duration
+	waitFail    bool
+	storagePath string
+	// tenant keeps the account, certificates and rate limits apart from
+	// other acme blocks sharing the storage
+	tenant string
+	// provider serves the DNS-01 challenge records
+	provider *Provider
+	// approvalAddress serves the admin endpoint of the approval queue, set
+	// by require_approval
+	approvalAddress string
+	approvals       *ApprovalQueue
+	// approvalTokens and approvalClientCA are the files authenticating
+	// administrators on the approval endpoint
+	approvalTokens   string
+	approvalClientCA string
+	// addresses are the apex A and AAAA addresses, and nameservers the NS
+	// set, both discovered when empty
+	addresses   []net.IP
+	nameservers []Nameserver
+	// dnssec signs the answers, set by the dnssec directive
+	dnssec *ZoneSigner
+	// transfer allows secondaries to transfer the zone, set by the
+	// transfer directive
+	transfer *TransferConfig
+}
+
+func parseACME(c *caddy.Controller) (acmeOptions, error) {
+	opts := acmeOptions{
+		template: certmagic.ACMEManager{
+			Agreed:                  true,
+			DisableHTTPChallenge:    true,
+			DisableTLSALPNChallenge: true,
+		},
+		rateLimits: defaultRateLimits(),
 	}
-	var zoneName string
 	for c.Next() {
 		for c.NextBlock() {
 			term := strings.ToLower(c.Val())
@@ -112,37 +395,633 @@ func parseACME(c *caddy.Controller) (certmagic.ACMEManager, string, error) {
 			case DOMAIN:
 				args := c.RemainingArgs()
 				if len(args) > 1 {
-					return acmeTemplate, zoneName, c.Errf("unexpected number of arguments: %#v", args)
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
 				}
-				zoneName = args[0]
+				opts.zone = args[0]
 			case CHALLENGE:
 				args := c.RemainingArgs()
 				challenge := args[0]
 				if !(len(args) == 3 && args[1] == PORT) {
-					return acmeTemplate, zoneName, c.Errf("unexpected number of arguments: %#v", args)
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
 				}
 				port, err := strconv.Atoi(args[2])
 				if err != nil {
-					return acmeTemplate, zoneName, c.Errf("%s port is not an int: %#v", challenge, args)
+					return opts, c.Errf("%s port is not an int: %#v", challenge, args)
 				}
 				switch challenge {
 				case HTTPChallenge:
-					acmeTemplate.AltHTTPPort = port
-					acmeTemplate.DisableHTTPChallenge = false
+					opts.template.AltHTTPPort = port
+					opts.template.DisableHTTPChallenge = false
 				case TLPSALPNChallenge:
-					acmeTemplate.AltTLSALPNPort = port
-					acmeTemplate.DisableTLSALPNChallenge = false
+					opts.template.AltTLSALPNPort = port
+					opts.template.DisableTLSALPNChallenge = false
 				default:
-					return acmeTemplate, zoneName, c.Errf("unexpected challenge %s: challenge should only be tlsalpn or http", challenge)
+					return opts, c.Errf("unexpected challenge %s: challenge should only be tlsalpn or http", challenge)
+				}
+			case RENEWBEFORE:
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				before, ratio, err := parseRenewBefore(args[0])
+				if err != nil {
+					return opts, c.Errf("%s: %v", term, err)
+				}
+				opts.renewal.Before, opts.renewal.Ratio = before, ratio
+			case RENEWJITTER:
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				jitter, err := time.ParseDuration(args[0])
+				if err != nil || jitter < 0 {
+					return opts, c.Errf("%s: invalid duration %s", term, args[0])
+				}
+				opts.renewal.Jitter = jitter
+			case RENEWWINDOW:
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				window, err := parseMaintenanceWindow(args[0], args[1])
+				if err != nil {
+					return opts, c.Errf("%s: %v", term, err)
+				}
+				opts.renewal.Windows = append(opts.renewal.Windows, window)
+			case RATELIMIT:
+				args := c.RemainingArgs()
+				if len(args) != 3 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				event := args[0]
+				if _, ok := opts.rateLimits[event]; !ok {
+					return opts, c.Errf("%s: unexpected event %s: event should only be orders, duplicates, failed_validations or accounts", term, event)
+				}
+				limit, err := strconv.Atoi(args[1])
+				if err != nil || limit < 0 {
+					return opts, c.Errf("%s: limit is not a non-negative int: %#v", term, args)
+				}
+				window, err := time.ParseDuration(args[2])
+				if err != nil || window <= 0 {
+					return opts, c.Errf("%s: invalid duration %s", term, args[2])
+				}
+				opts.rateLimits[event] = RateLimit{Limit: limit, Window: window}
+			case IP:
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				for _, arg := range args {
+					ip := net.ParseIP(arg)
+					if ip == nil {
+						return opts, c.Errf("%s: %s is not an IP address", term, arg)
+					}
+					opts.ips = append(opts.ips, ip.String())
+				}
+			case ISSUER:
+				if err := parseIssuer(c, &opts); err != nil {
+					return opts, err
+				}
+			case WAITFORCERT:
+				args := c.RemainingArgs()
+				if len(args) != 1 && len(args) != 2 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				timeout, err := time.ParseDuration(args[0])
+				if err != nil || timeout <= 0 {
+					return opts, c.Errf("%s: invalid duration %s", term, args[0])
+				}
+				opts.waitForCert, opts.waitFail = timeout, true
+				if len(args) == 2 {
+					switch args[1] {
+					case "fail":
+					case "continue":
+						opts.waitFail = false
+					default:
+						return opts, c.Errf("%s: unexpected action %s: action should only be fail or continue", term, args[1])
+					}
+				}
+			case STORAGE:
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				opts.storagePath = args[0]
+			case TENANT:
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				if strings.ContainsAny(args[0], `/\`) || args[0] == "." || args[0] == ".." {
+					return opts, c.Errf("%s: invalid name %s", term, args[0])
+				}
+				opts.tenant = args[0]
+			case EMAIL:
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				if _, err := mail.ParseAddress(args[0]); err != nil {
+					return opts, c.Errf("%s: invalid address %s", term, args[0])
+				}
+				opts.template.Email = args[0]
+			case EAB:
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				opts.template.ExternalAccount = &acme.EAB{KeyID: args[0], MACKey: args[1]}
+			case CA:
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				u, err := url.Parse(args[0])
+				if err != nil || u.Scheme != "https" || u.Host == "" {
+					return opts, c.Errf("%s: invalid directory URL %s", term, args[0])
+				}
+				opts.template.CA = args[0]
+			case REQUIREAPPROVAL:
+				if err := parseRequireApproval(c, &opts); err != nil {
+					return opts, err
+				}
+			case CAA:
+				if opts.caa == nil {
+					opts.caa = &CAAPolicy{}
+				}
+				if err := parseCAA(c, opts.caa); err != nil {
+					return opts, err
+				}
+			case ADDRESS:
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				for _, arg := range args {
+					ip := net.ParseIP(arg)
+					if ip == nil {
+						return opts, c.Errf("%s: %s is not an IP address", term, arg)
+					}
+					opts.addresses = append(opts.addresses, ip)
+				}
+			case NAMESERVER:
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				if _, ok := dns.IsDomainName(args[0]); !ok {
+					return opts, c.Errf("%s: invalid name %s", term, args[0])
+				}
+				ns := Nameserver{Name: dns.Fqdn(strings.ToLower(args[0]))}
+				for _, arg := range args[1:] {
+					ip := net.ParseIP(arg)
+					if ip == nil {
+						return opts, c.Errf("%s: %s is not an IP address", term, arg)
+					}
+					ns.Addresses = append(ns.Addresses, ip)
+				}
+				opts.nameservers = append(opts.nameservers, ns)
+			case TTL:
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return opts, c.Errf("unexpected number of arguments: %#v", args)
+				}
+				seconds, err := parseSeconds(args[1])
+				if err != nil {
+					return opts, c.Errf("%s %s: %v", term, args[0], err)
+				}
+				switch args[0] {
+				case "apex":
+					opts.ttl.Apex = seconds
+				case "challenge":
+					opts.ttl.Challenge = seconds
+				case "negative":
+					opts.ttl.Negative = seconds
+				default:
+					return opts, c.Errf("unexpected %s record class %s: class should only be apex, challenge or negative", term, args[0])
+				}
+			case SOA:
+				if err := parseSOA(c, &opts.soa); err != nil {
+					return opts, err
+				}
+			case TRANSFER:
+				if opts.transfer == nil {
+					opts.transfer = &TransferConfig{}
+				}
+				if err := parseTransfer(c, opts.transfer); err != nil {
+					return opts, err
+				}
+			case DNSSEC:
+				if opts.dnssec == nil {
+					opts.dnssec = &ZoneSigner{}
+				}
+				if err := parseDNSSEC(c, opts.dnssec); err != nil {
+					return opts, err
+				}
+			case FALLTHROUGH:
+				opts.fall.SetZonesFromArgs(c.RemainingArgs())
+			case POLICY:
+				if opts.policy == nil {
+					opts.policy = &NamePolicy{}
+				}
+				if err := parsePolicy(c, opts.policy); err != nil {
+					return opts, err
+				}
+			case ONDEMAND:
+				if opts.onDemand == nil {
+					opts.onDemand = newOnDemandPolicy("")
+				}
+				if err := parseOnDemand(c, opts.onDemand); err != nil {
+					return opts, err
 				}
 			default:
-				return acmeTemplate, zoneName, c.Errf("unexpected term: %s: term should only be challenge or domain", term)
+				return opts, c.Errf("unexpected term: %s: term should only be address, ca, caa, challenge, dnssec, domain, eab, email, fallthrough, ip, issuer, nameserver, policy, require_approval, soa, storage, tenant, transfer, ttl, renew_before, renew_jitter, renew_window, ratelimit, wait_for_cert or on_demand", term)
+			}
+		}
+	}
+	if opts.zone == "" {
+		return opts, c.Errf("Domain not provided")
+	}
+	if opts.issuer == "" {
+		opts.issuer = ACMEIssuer
+	}
+	if opts.issuer == InternalIssuer && opts.approvalAddress != "" {
+		return opts, c.Errf("%s only applies to the %s issuer", REQUIREAPPROVAL, ACMEIssuer)
+	}
+	if opts.approvalAddress != "" && opts.approvalTokens == "" && opts.approvalClientCA == "" && !isLoopbackAddress(opts.approvalAddress) {
+		return opts, c.Errf("%s: %s is not a loopback address, set tokens or client_ca to authenticate administrators", REQUIREAPPROVAL, opts.approvalAddress)
+	}
+	if opts.issuer == ACMEIssuer && len(opts.ips) > 0 && opts.template.DisableHTTPChallenge && opts.template.DisableTLSALPNChallenge {
+		// the DNS-01 challenge cannot validate IP identifiers
+		return opts, c.Errf("%s requires the http or tlsalpn challenge", IP)
+	}
+	for _, ns := range opts.nameservers {
+		if dns.IsSubDomain(dns.Fqdn(strings.ToLower(opts.zone)), ns.Name) && len(ns.Addresses) == 0 {
+			return opts, c.Errf("%s: %s is inside %s and needs its addresses for glue", NAMESERVER, ns.Name, opts.zone)
+		}
+	}
+	if opts.dnssec != nil {
+		if (opts.dnssec.KSKFile == "") != (opts.dnssec.ZSKFile == "") {
+			return opts, c.Errf("%s needs both the ksk and zsk key files, or neither to generate the keys", DNSSEC)
+		}
+		opts.dnssec.Zone = dns.Fqdn(strings.ToLower(opts.zone))
+	}
+	if opts.transfer != nil && len(opts.transfer.To) == 0 {
+		return opts, c.Errf("%s needs the addresses of the secondaries allowed to transfer the zone", TRANSFER)
+	}
+	if opts.transfer != nil && opts.dnssec != nil {
+		// transfers carry the unsigned records, which secondaries would
+		// serve as bogus answers under the DS record of the parent zone
+		return opts, c.Errf("%s cannot be combined with %s: transfers do not carry the signatures of the zone", TRANSFER, DNSSEC)
+	}
+	if opts.policy != nil {
+		opts.policy.Zone = opts.zone
+	}
+	if opts.onDemand != nil {
+		if !opts.onDemand.hasAllowPolicy() {
+			return opts, c.Errf("%s requires at least one allow, regex or ask policy", ONDEMAND)
+		}
+		opts.onDemand.Zone = opts.zone
+	}
+	if opts.template.CA == "" {
+		opts.template.CA = certmagic.LetsEncryptProductionCA
+	}
+	if opts.caa == nil {
+		opts.caa = &CAAPolicy{}
+	}
+	if len(opts.caa.Issue) == 0 && len(opts.caa.IssueWild) == 0 {
+		opts.caa.Auto = true
+	}
+	if opts.caa.Auto && opts.issuer == ACMEIssuer && !opts.caa.configure(opts.template) {
+		log.Warningf("No CAA issuer domain is known for %s, configure it with %s issue", opts.template.CA, CAA)
+	}
+	opts.renewal = newRenewalPolicy(opts.renewal)
+	return opts, nil
+}
+
+// parseRequireApproval parses the address of the approval endpoint and
+// how administrators authenticate to it: tokens FILE for bearer tokens,
+// client_ca FILE for client certificates.
+func parseRequireApproval(c *caddy.Controller, opts *acmeOptions) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args)%2 != 1 {
+		return c.Errf("unexpected number of arguments: %#v", args)
+	}
+	if _, _, err := net.SplitHostPort(args[0]); err != nil {
+		return c.Errf("%s: invalid address %s", REQUIREAPPROVAL, args[0])
+	}
+	opts.approvalAddress = args[0]
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "tokens":
+			opts.approvalTokens = args[i+1]
+		case "client_ca":
+			opts.approvalClientCA = args[i+1]
+		default:
+			return c.Errf("%s: unknown option %s, expected tokens or client_ca", REQUIREAPPROVAL, args[i])
+		}
+	}
+	return nil
+}
+
+func parseIssuer(c *caddy.Controller, opts *acmeOptions) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.Errf("unexpected number of arguments: %#v", args)
+	}
+	switch args[0] {
+	case ACMEIssuer:
+		if len(args) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+	case InternalIssuer:
+		options := args[1:]
+		if len(options)%2 != 0 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		for i := 0; i < len(options); i += 2 {
+			option, value := options[i], options[i+1]
+			switch option {
+			case "lifetime":
+				lifetime, err := time.ParseDuration(value)
+				if err != nil || lifetime <= 0 {
+					return c.Errf("%s %s: invalid duration %s", ISSUER, option, value)
+				}
+				opts.leafLifetime = lifetime
+			case "root":
+				opts.rootPath = value
+			default:
+				return c.Errf("unexpected %s option %s: option should only be lifetime or root", ISSUER, option)
+			}
+		}
+	default:
+		return c.Errf("unexpected issuer %s: issuer should only be acme or internal", args[0])
+	}
+	opts.issuer = args[0]
+	return nil
+}
+
+func parseSOA(c *caddy.Controller, soa *SOAConfig) error {
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return c.Errf("unexpected number of arguments: %#v", args)
+	}
+	field, value := args[0], args[1]
+	switch field {
+	case "mname":
+		if _, ok := dns.IsDomainName(value); !ok {
+			return c.Errf("%s %s: invalid name %s", SOA, field, value)
+		}
+		soa.Mname = dns.Fqdn(value)
+	case "rname":
+		// an address such as hostmaster@example.com is turned into the
+		// mailbox name hostmaster.example.com.
+		if at := strings.LastIndex(value, "@"); at >= 0 {
+			value = strings.ReplaceAll(value[:at], ".", `\.`) + "." + value[at+1:]
+		}
+		if _, ok := dns.IsDomainName(value); !ok {
+			return c.Errf("%s %s: invalid mailbox %s", SOA, field, args[1])
+		}
+		soa.Rname = dns.Fqdn(value)
+	case "refresh", "retry", "expire", "minimum":
+		seconds, err := parseSeconds(value)
+		if err != nil {
+			return c.Errf("%s %s: %v", SOA, field, err)
+		}
+		switch field {
+		case "refresh":
+			soa.Refresh = seconds
+		case "retry":
+			soa.Retry = seconds
+		case "expire":
+			soa.Expire = seconds
+		case "minimum":
+			soa.Minimum = seconds
+		}
+	default:
+		return c.Errf("unexpected %s field %s: field should only be mname, rname, refresh, retry, expire or minimum", SOA, field)
+	}
+	return nil
+}
+
+// parseSeconds parses a positive number of seconds, given as such or as a
+// duration.
+func parseSeconds(value string) (uint32, error) {
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil && seconds > 0 {
+		return uint32(seconds), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Second || d.Seconds() > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid duration %s", value)
+	}
+	return uint32(d.Seconds()), nil
+}
+
+// parseTransfer parses a transfer line: the addresses or networks of the
+// secondaries, or a TSIG key.
+func parseTransfer(c *caddy.Controller, transfer *TransferConfig) error {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.Errf("unexpected number of arguments: %#v", args)
+	}
+	option, values := args[0], args[1:]
+	switch option {
+	case "to":
+		for _, value := range values {
+			if value == "*" {
+				_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+				_, v6, _ := net.ParseCIDR("::/0")
+				transfer.To = append(transfer.To, v4, v6)
+				continue
+			}
+			if _, network, err := net.ParseCIDR(value); err == nil {
+				transfer.To = append(transfer.To, network)
+				continue
+			}
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return c.Errf("%s %s: %s is not an IP address or network", TRANSFER, option, value)
 			}
+			transfer.To = append(transfer.To, hostNetwork(ip))
+		}
+	case "tsig":
+		if len(values) != 3 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		name, algorithm, secret := values[0], values[1], values[2]
+		if _, ok := dns.IsDomainName(name); !ok {
+			return c.Errf("%s %s: invalid key name %s", TRANSFER, option, name)
+		}
+		tsigAlgorithm, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(algorithm, "."))]
+		if !ok {
+			return c.Errf("%s %s: unsupported algorithm %s", TRANSFER, option, algorithm)
 		}
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			return c.Errf("%s %s: the secret of %s is not base64 encoded", TRANSFER, option, name)
+		}
+		transfer.Keys = append(transfer.Keys, TSIGKey{Name: dns.Fqdn(strings.ToLower(name)), Algorithm: tsigAlgorithm, Secret: secret})
+	default:
+		return c.Errf("unexpected %s option %s: option should only be to or tsig", TRANSFER, option)
+	}
+	return nil
+}
+
+// parseDNSSEC parses a dnssec line: either no arguments, or the BIND key
+// file of the KSK or ZSK.
+func parseDNSSEC(c *caddy.Controller, signer *ZoneSigner) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil
 	}
-	if zoneName == "" {
-		return acmeTemplate, zoneName, c.Errf("Domain not provided")
+	if len(args) != 2 {
+		return c.Errf("unexpected number of arguments: %#v", args)
 	}
-	acmeTemplate.CA = certmagic.LetsEncryptProductionCA
-	return acmeTemplate, zoneName, nil
+	switch args[0] {
+	case "ksk":
+		signer.KSKFile = args[1]
+	case "zsk":
+		signer.ZSKFile = args[1]
+	default:
+		return c.Errf("unexpected %s key %s: key should only be ksk or zsk", DNSSEC, args[0])
+	}
+	return nil
+}
+
+func parseCAA(c *caddy.Controller, policy *CAAPolicy) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.Errf("unexpected number of arguments: %#v", args)
+	}
+	option, values := args[0], args[1:]
+	switch option {
+	case "auto":
+		if len(values) != 0 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		policy.Auto = true
+	case "issue", "issuewild", "iodef":
+		if len(values) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		switch option {
+		case "issue":
+			policy.Issue = append(policy.Issue, values[0])
+		case "issuewild":
+			policy.IssueWild = append(policy.IssueWild, values[0])
+		case "iodef":
+			u, err := url.Parse(values[0])
+			if err != nil || (u.Scheme != "mailto" && u.Scheme != "http" && u.Scheme != "https") {
+				return c.Errf("%s %s: invalid URL %s", CAA, option, values[0])
+			}
+			policy.Iodef = append(policy.Iodef, values[0])
+		}
+	default:
+		return c.Errf("unexpected %s option %s: option should only be auto, issue, issuewild or iodef", CAA, option)
+	}
+	return nil
+}
+
+func parsePolicy(c *caddy.Controller, policy *NamePolicy) error {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.Errf("unexpected number of arguments: %#v", args)
+	}
+	option, values := args[0], args[1:]
+	switch option {
+	case "allow":
+		policy.Allow = append(policy.Allow, values...)
+	case "deny":
+		policy.Deny = append(policy.Deny, values...)
+	case "allow_suffix":
+		policy.AllowSuffix = append(policy.AllowSuffix, values...)
+	case "deny_suffix":
+		policy.DenySuffix = append(policy.DenySuffix, values...)
+	case "allow_regex", "deny_regex":
+		if len(values) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		re, err := regexp.Compile(values[0])
+		if err != nil {
+			return c.Errf("%s %s: %v", POLICY, option, err)
+		}
+		if option == "allow_regex" {
+			policy.AllowRegex = append(policy.AllowRegex, re)
+		} else {
+			policy.DenyRegex = append(policy.DenyRegex, re)
+		}
+	case "max_sans", "max_labels":
+		if len(values) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		max, err := strconv.Atoi(values[0])
+		if err != nil || max < 0 {
+			return c.Errf("%s %s: not a non-negative int: %#v", POLICY, option, args)
+		}
+		if option == "max_sans" {
+			policy.MaxSANs = max
+		} else {
+			policy.MaxLabels = max
+		}
+	default:
+		return c.Errf("unexpected %s option %s: option should only be allow, deny, allow_suffix, deny_suffix, allow_regex, deny_regex, max_sans or max_labels", POLICY, option)
+	}
+	return nil
+}
+
+func parseOnDemand(c *caddy.Controller, policy *OnDemandPolicy) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil
+	}
+	option, values := args[0], args[1:]
+	switch option {
+	case "allow":
+		if len(values) == 0 {
+			return c.Errf("%s %s: no names given", ONDEMAND, option)
+		}
+		policy.Allow = append(policy.Allow, values...)
+	case "regex":
+		if len(values) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		re, err := regexp.Compile(values[0])
+		if err != nil {
+			return c.Errf("%s %s: %v", ONDEMAND, option, err)
+		}
+		policy.Regex = append(policy.Regex, re)
+	case "ask":
+		if len(values) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		u, err := url.Parse(values[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return c.Errf("%s %s: invalid URL %s", ONDEMAND, option, values[0])
+		}
+		policy.Ask = values[0]
+	case "rate":
+		if len(values) != 2 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		limit, err := strconv.Atoi(values[0])
+		if err != nil || limit < 0 {
+			return c.Errf("%s %s: limit is not a non-negative int: %#v", ONDEMAND, option, args)
+		}
+		window, err := time.ParseDuration(values[1])
+		if err != nil || window <= 0 {
+			return c.Errf("%s %s: invalid duration %s", ONDEMAND, option, values[1])
+		}
+		policy.Rate = RateLimit{Limit: limit, Window: window}
+	case "max":
+		if len(values) != 1 {
+			return c.Errf("unexpected number of arguments: %#v", args)
+		}
+		max, err := strconv.Atoi(values[0])
+		if err != nil || max < 0 {
+			return c.Errf("%s %s: not a non-negative int: %#v", ONDEMAND, option, args)
+		}
+		policy.MaxCerts = max
+	default:
+		return c.Errf("unexpected %s option %s: option should only be allow, regex, ask, rate or max", ONDEMAND, option)
+	}
+	return nil
 }
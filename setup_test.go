@@ -1,6 +1,8 @@
 package acme
 
 import (
+	"net"
+	"strings"
 	"testing"
 
 	"github.com/caddyserver/certmagic"
@@ -102,11 +104,701 @@ func TestSetup(t *testing.T) {
 			certmagic.ACMEManager{},
 			"test.domain",
 		},
+		{
+			"Correct Config with renewal policy",
+			`acme {
+				domain test.domain
+				renew_before 720h
+				renew_jitter 6h
+				renew_window 02:00 05:00
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Correct Config with renewal percentage",
+			`acme {
+				domain test.domain
+				renew_before 25%
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid renewal percentage",
+			`acme {
+				domain test.domain
+				renew_before 120%
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid renewal window",
+			`acme {
+				domain test.domain
+				renew_window 02:00
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with rate limits",
+			`acme {
+				domain test.domain
+				ratelimit orders 3 168h
+				ratelimit duplicates 2 168h
+				ratelimit accounts 0 3h
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid rate limit event",
+			`acme {
+				domain test.domain
+				ratelimit certificates 3 168h
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with on demand TLS",
+			`acme {
+				domain test.domain
+				on_demand
+				on_demand regex ^t[0-9]+\.test\.domain$
+				on_demand allow a.test.domain b.test.domain
+				on_demand ask http://127.0.0.1:8080/check
+				on_demand rate 2 1h
+				on_demand max 100
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"On demand TLS without allow policy",
+			`acme {
+				domain test.domain
+				on_demand
+				on_demand max 100
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid on demand regex",
+			`acme {
+				domain test.domain
+				on_demand regex (
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with IP identifiers",
+			`acme {
+				domain test.domain
+				ip 203.0.113.5 2001:db8::53
+				challenge http port 80
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    false,
+				DisableTLSALPNChallenge: true,
+				AltHTTPPort:             80,
+			},
+			"test.domain",
+		},
+		{
+			"IP identifiers with only the DNS challenge",
+			`acme {
+				domain test.domain
+				ip 203.0.113.5
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid IP identifier",
+			`acme {
+				domain test.domain
+				ip 203.0.113
+				challenge http port 80
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with internal issuer",
+			`acme {
+				domain test.domain
+				issuer internal lifetime 12h root /tmp/root.pem
+				ip 203.0.113.5
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid issuer",
+			`acme {
+				domain test.domain
+				issuer selfsigned
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid internal issuer lifetime",
+			`acme {
+				domain test.domain
+				issuer internal lifetime forever
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with wait_for_cert",
+			`acme {
+				domain test.domain
+				wait_for_cert 2m continue
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid wait_for_cert action",
+			`acme {
+				domain test.domain
+				wait_for_cert 2m retry
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid wait_for_cert timeout",
+			`acme {
+				domain test.domain
+				wait_for_cert
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with storage",
+			`acme {
+				domain test.domain
+				storage /var/lib/coredns/acme
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid storage",
+			`acme {
+				domain test.domain
+				storage
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with tenant account",
+			`acme {
+				domain bu1.corp.example.com
+				tenant bu1
+				email pki@bu1.corp.example.com
+				ca https://acme.zerossl.com/v2/DV90
+				eab kid-1 bWFjLWtleQ
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"bu1.corp.example.com",
+		},
+		{
+			"Invalid tenant",
+			`acme {
+				domain test.domain
+				tenant ../bu2
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid email",
+			`acme {
+				domain test.domain
+				email pki
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid eab",
+			`acme {
+				domain test.domain
+				eab kid-1
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with require_approval",
+			`acme {
+				domain regulated.test.domain
+				require_approval 127.0.0.1:8443
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"regulated.test.domain",
+		},
+		{
+			"Invalid require_approval address",
+			`acme {
+				domain test.domain
+				require_approval 8443
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid require_approval on a public address without authentication",
+			`acme {
+				domain test.domain
+				require_approval 0.0.0.0:8443
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid require_approval on every address without authentication",
+			`acme {
+				domain test.domain
+				require_approval :8443
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with require_approval tokens and client_ca",
+			`acme {
+				domain regulated.test.domain
+				require_approval 0.0.0.0:8443 tokens /etc/coredns/approvers client_ca /etc/coredns/admin-ca.pem
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"regulated.test.domain",
+		},
+		{
+			"Invalid require_approval option",
+			`acme {
+				domain test.domain
+				require_approval 0.0.0.0:8443 password secret
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid require_approval with internal issuer",
+			`acme {
+				domain test.domain
+				issuer internal
+				require_approval 127.0.0.1:8443
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with policy",
+			`acme {
+				domain test.domain
+				policy allow_suffix test.domain
+				policy deny admin.test.domain
+				policy deny_regex ^xn--
+				policy max_labels 4
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid policy option",
+			`acme {
+				domain test.domain
+				policy permit test.domain
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid policy max_sans",
+			`acme {
+				domain test.domain
+				policy max_sans many
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with fallthrough",
+			`acme {
+				domain test.domain
+				fallthrough test.domain
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Correct Config with caa",
+			`acme {
+				domain test.domain
+				caa auto
+				caa issuewild ";"
+				caa iodef mailto:security@test.domain
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid caa iodef",
+			`acme {
+				domain test.domain
+				caa iodef security@test.domain
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid caa option",
+			`acme {
+				domain test.domain
+				caa issuer letsencrypt.org
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with soa",
+			`acme {
+				domain test.domain
+				soa mname ns1.test.domain
+				soa rname dns.admin@test.domain
+				soa refresh 2h
+				soa retry 900
+				soa expire 336h
+				soa minimum 30
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid soa field",
+			`acme {
+				domain test.domain
+				soa serial 1
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid soa refresh",
+			`acme {
+				domain test.domain
+				soa refresh soon
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with address",
+			`acme {
+				domain test.domain
+				address 203.0.113.5 2001:db8::5
+				address 198.51.100.7
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid address",
+			`acme {
+				domain test.domain
+				address ns1.test.domain
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with ttl",
+			`acme {
+				domain test.domain
+				ttl apex 1h
+				ttl challenge 10
+				ttl negative 5m
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid ttl class",
+			`acme {
+				domain test.domain
+				ttl txt 10
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid ttl",
+			`acme {
+				domain test.domain
+				ttl apex -1h
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with nameserver",
+			`acme {
+				domain test.domain
+				nameserver ns1.test.domain 203.0.113.1 2001:db8::1
+				nameserver ns.provider.example
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid nameserver address",
+			`acme {
+				domain test.domain
+				nameserver ns1.test.domain ns1
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid nameserver without glue",
+			`acme {
+				domain test.domain
+				nameserver ns1.test.domain
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with dnssec",
+			`acme {
+				domain test.domain
+				dnssec
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Correct Config with dnssec key files",
+			`acme {
+				domain test.domain
+				dnssec ksk Ktest.domain.+013+12345
+				dnssec zsk Ktest.domain.+013+23456.key
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid dnssec with only a ksk",
+			`acme {
+				domain test.domain
+				dnssec ksk Ktest.domain.+013+12345
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid dnssec key",
+			`acme {
+				domain test.domain
+				dnssec csk Ktest.domain.+013+12345
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Correct Config with transfer",
+			`acme {
+				domain test.domain
+				transfer to 192.0.2.1 2001:db8::1 198.51.100.0/24
+				transfer tsig transfer.key hmac-sha256 c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1zZWNvbmRhcnk=
+			}`,
+			false,
+			certmagic.ACMEManager{
+				DisableHTTPChallenge:    true,
+				DisableTLSALPNChallenge: true,
+			},
+			"test.domain",
+		},
+		{
+			"Invalid transfer address",
+			`acme {
+				domain test.domain
+				transfer to secondary.test.domain
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid transfer tsig algorithm",
+			`acme {
+				domain test.domain
+				transfer to 192.0.2.1
+				transfer tsig transfer.key hmac-md5 c2VjcmV0
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid transfer without to",
+			`acme {
+				domain test.domain
+				transfer tsig transfer.key hmac-sha256 c2VjcmV0
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid transfer of a signed zone",
+			`acme {
+				domain test.domain
+				dnssec
+				transfer to 192.0.2.1
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
+		{
+			"Invalid ca",
+			`acme {
+				domain test.domain
+				ca http://acme.example.com/directory
+			}`,
+			true,
+			certmagic.ACMEManager{},
+			"test.domain",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			c := caddy.NewTestController("acme", test.input)
-			acmeTemplate, zoneName, err := parseACME(c)
+			opts, err := parseACME(c)
+			acmeTemplate, zoneName := opts.template, opts.zone
 			if (err != nil) != test.shouldErr {
 				t.Errorf("Error: setup() error = %v, shouldErr %v", err, test.shouldErr)
 			} else {
@@ -122,3 +814,47 @@ func TestSetup(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSOA(t *testing.T) {
+	c := caddy.NewTestController("acme", `acme {
+		domain test.domain
+		soa mname ns1.test.domain
+		soa rname dns.admin@test.domain
+		soa refresh 2h
+		soa minimum 30
+	}`)
+	opts, err := parseACME(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SOAConfig{Mname: "ns1.test.domain.", Rname: `dns\.admin.test.domain.`, Refresh: 7200, Minimum: 30}
+	if opts.soa != expected {
+		t.Errorf("Error: expected SOA %+v but got %+v", expected, opts.soa)
+	}
+}
+
+func TestPropagationResolvers(t *testing.T) {
+	addresses := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	expected := []string{"192.0.2.1:53", "192.0.2.2:53", "[2001:db8::1]:53"}
+	resolvers := propagationResolvers(addresses)
+	if strings.Join(resolvers, ",") != strings.Join(expected, ",") {
+		t.Errorf("Error: expected resolvers %v but got %v", expected, resolvers)
+	}
+}
+
+func TestIsLoopbackAddress(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:8443": true,
+		"[::1]:8443":     true,
+		"localhost:8443": true,
+		"0.0.0.0:8443":   false,
+		"[::]:8443":      false,
+		"192.0.2.1:8443": false,
+		":8443":          false,
+	}
+	for address, expected := range tests {
+		if loopback := isLoopbackAddress(address); loopback != expected {
+			t.Errorf("Error: expected %s loopback %v but got %v", address, expected, loopback)
+		}
+	}
+}
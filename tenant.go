@@ -0,0 +1,63 @@
+package acme
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// tenantStorage keeps a tenant's accounts, certificates and plugin state
+// under their own prefix of the shared storage, so that tenants with their
+// own CA accounts never read or lock each other's keys.
+type tenantStorage struct {
+	certmagic.Storage
+	prefix string
+}
+
+func newTenantStorage(storage certmagic.Storage, tenant string) *tenantStorage {
+	return &tenantStorage{Storage: storage, prefix: path.Join("tenants", tenant)}
+}
+
+func (s *tenantStorage) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *tenantStorage) Lock(ctx context.Context, key string) error {
+	return s.Storage.Lock(ctx, s.key(key))
+}
+
+func (s *tenantStorage) Unlock(key string) error {
+	return s.Storage.Unlock(s.key(key))
+}
+
+func (s *tenantStorage) Store(key string, value []byte) error {
+	return s.Storage.Store(s.key(key), value)
+}
+
+func (s *tenantStorage) Load(key string) ([]byte, error) {
+	return s.Storage.Load(s.key(key))
+}
+
+func (s *tenantStorage) Delete(key string) error {
+	return s.Storage.Delete(s.key(key))
+}
+
+func (s *tenantStorage) Exists(key string) bool {
+	return s.Storage.Exists(s.key(key))
+}
+
+func (s *tenantStorage) List(prefix string, recursive bool) ([]string, error) {
+	keys, err := s.Storage.List(s.key(prefix), recursive)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix+"/")
+	}
+	return keys, err
+}
+
+func (s *tenantStorage) Stat(key string) (certmagic.KeyInfo, error) {
+	info, err := s.Storage.Stat(s.key(key))
+	info.Key = strings.TrimPrefix(info.Key, s.prefix+"/")
+	return info, err
+}
@@ -0,0 +1,53 @@
+package acme
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestTenantStorage(t *testing.T) {
+	shared := &certmagic.FileStorage{Path: t.TempDir()}
+	first := newTenantStorage(shared, "bu1")
+	second := newTenantStorage(shared, "bu2")
+	key := "certificates/acme/test.domain/test.domain.crt"
+	if err := first.Store(key, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if second.Exists(key) {
+		t.Errorf("Error: expected %s to be invisible to another tenant", key)
+	}
+	if !shared.Exists("tenants/bu1/" + key) {
+		t.Errorf("Error: expected %s under the tenant's prefix", key)
+	}
+	keys, err := first.List("certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := false
+	for _, k := range keys {
+		listed = listed || k == key
+	}
+	if !listed {
+		t.Errorf("Error: expected %s to be listed but got %v", key, keys)
+	}
+	info, err := first.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != key {
+		t.Errorf("Error: expected stat of %s but got %s", key, info.Key)
+	}
+
+	// a tenant's ledger does not count the other tenant's orders
+	limits := map[string]RateLimit{OrderEvent: {Limit: 1, Window: 24 * time.Hour}}
+	ctx := context.Background()
+	if err := (&Ledger{Storage: first, Limits: limits}).Reserve(ctx, OrderEvent, "bu1.corp.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Ledger{Storage: second, Limits: limits}).Reserve(ctx, OrderEvent, "bu2.corp.example.com"); err != nil {
+		t.Errorf("Error: expected the other tenant's order to be allowed: %v", err)
+	}
+}
@@ -1,12 +1,27 @@
 package acme
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"sync"
+	"time"
 
-	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/caddyserver/certmagic"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/mholt/acmez"
 )
 
-func configureTLS(a ACME, zone string, conf *dnsserver.Config) error {
+// temporaryCertificateLifetime only needs to outlast the first issuance.
+const temporaryCertificateLifetime = 7 * 24 * time.Hour
+
+// configureTLS swaps the managed certificates into the TLS config installed
+// by newTemporaryTLSConfig.
+func configureTLS(a ACME, zone string, certs *certSwitch) error {
 	err := a.GetCert(zone)
 	if err != nil {
 		return err
@@ -15,12 +30,157 @@ func configureTLS(a ACME, zone string, conf *dnsserver.Config) error {
 	if err != nil {
 		return err
 	}
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert.Certificate}}
+	for _, ip := range a.IPs {
+		if err := a.GetCert(ip); err != nil {
+			return err
+		}
+		if _, err := a.Config.CacheManagedCertificate(ip); err != nil {
+			return err
+		}
+	}
+	// certificates are looked up in certmagic's cache on every handshake, so
+	// renewed ones are served as soon as they are reloaded
+	certs.swap(a.getCertificate, cert.Certificate)
+	return nil
+}
+
+// certSwitches holds the certSwitch of each zone. Certificates are only
+// issued and swapped in on the first startup, so a reloaded server keeps
+// the switch of the previous one rather than going back to a temporary
+// certificate.
+var (
+	certSwitchesMu sync.Mutex
+	certSwitches   = make(map[string]*certSwitch)
+)
+
+// newTemporaryTLSConfig returns a TLS config serving a self-signed
+// certificate for zone and ips, so that TLS servers have something to serve
+// before the first certificate is issued. After a reload it serves the
+// certificates already swapped in.
+func newTemporaryTLSConfig(zone string, ips []string) (*tls.Config, *certSwitch, error) {
+	certSwitchesMu.Lock()
+	defer certSwitchesMu.Unlock()
+	certs, ok := certSwitches[zone]
+	if !ok {
+		temporary, err := newTemporaryCertificate(zone, ips)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = &certSwitch{zone: zone, fallback: temporary, ready: make(chan struct{})}
+		certSwitches[zone] = certs
+	}
+	tlsConfig := &tls.Config{}
+	tlsConfig.GetCertificate = certs.GetCertificate
 	tlsConfig.ClientAuth = tls.NoClientCert
 	tlsConfig.ClientCAs = tlsConfig.RootCAs
 
 	setTLSDefaults(tlsConfig)
 
-	conf.TLSConfig = tlsConfig
-	return nil
+	if !certs.swapped() {
+		log.Warningf("Serving a temporary self-signed certificate for %s until its certificate is issued", zone)
+		temporaryCertificate.WithLabelValues(zone).Set(1)
+	}
+	return tlsConfig, certs, nil
+}
+
+func newTemporaryCertificate(zone string, ips []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: zone},
+		DNSNames:     []string{zone},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(temporaryCertificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, ip := range ips {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// certSwitch serves the temporary certificate until swap installs the
+// managed certificates. ready is closed by the swap.
+type certSwitch struct {
+	zone           string
+	ready          chan struct{}
+	mu             sync.RWMutex
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	fallback       tls.Certificate
+}
+
+func (s *certSwitch) swap(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), fallback tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.getCertificate == nil {
+		close(s.ready)
+	}
+	s.getCertificate, s.fallback = getCertificate, fallback
+	temporaryCertificate.WithLabelValues(s.zone).Set(0)
+}
+
+// swapped reports whether the managed certificates have been swapped in.
+func (s *certSwitch) swapped() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getCertificate != nil
+}
+
+func (s *certSwitch) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	getCertificate, fallback := s.getCertificate, s.fallback
+	s.mu.RUnlock()
+	if getCertificate != nil {
+		cert, err := getCertificate(hello)
+		if cert != nil || err != nil {
+			return cert, err
+		}
+	}
+	return &fallback, nil
+}
+
+// getCertificate selects the certificate for a ClientHello. Without SNI
+// certmagic prefers the certificate for the local IP address and falls back
+// to the zone's. Names without a certificate get the zone's certificate
+// from certSwitch, unless on_demand obtains one for them.
+func (a ACME) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto != acmez.ACMETLS1Protocol {
+			continue
+		}
+		// certmagic cannot answer TLS-ALPN challenges for IP identifiers,
+		// whose SNI is the reverse mapping name of the address
+		if ip := ipFromReverseName(hello.ServerName); ip != nil {
+			if chal, ok := certmagic.GetACMEChallenge(ip.String()); ok {
+				a.Inventory.recordChallenge(ip.String(), chal.Type)
+				return tlsALPNIPChallengeCert(chal.Challenge)
+			}
+		}
+	}
+	cfg := a.Config
+	if a.OnDemandConfig != nil {
+		cfg = a.OnDemandConfig
+	}
+	cert, err := cfg.GetCertificate(hello)
+	if err != nil {
+		log.Debugf("no certificate for %q, serving the certificate for %s: %v", hello.ServerName, a.Zone, err)
+		return nil, nil
+	}
+	return cert, nil
 }
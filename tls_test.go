@@ -0,0 +1,92 @@
+package acme
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTemporaryTLSConfig(t *testing.T) {
+	tlsConfig, certs, err := newTemporaryTLSConfig("dns.example.com", []string{"203.0.113.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &tls.ClientHelloInfo{ServerName: "dns.example.com"}
+	temporary, err := tlsConfig.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := temporary.Leaf.VerifyHostname("dns.example.com"); err != nil {
+		t.Errorf("Error: temporary certificate does not cover the zone: %v", err)
+	}
+	if err := temporary.Leaf.VerifyHostname("203.0.113.5"); err != nil {
+		t.Errorf("Error: temporary certificate does not cover the IP: %v", err)
+	}
+
+	managed, err := newTemporaryCertificate("dns.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDemand, err := newTemporaryCertificate("t1.dns.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.swap(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "t1.dns.example.com" {
+			return &onDemand, nil
+		}
+		return nil, nil
+	}, managed)
+	tests := []struct {
+		serverName string
+		expected   *tls.Certificate
+	}{
+		{"dns.example.com", &managed},
+		{"t1.dns.example.com", &onDemand},
+		{"", &managed},
+	}
+	for _, test := range tests {
+		cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf != test.expected.Leaf {
+			t.Errorf("Error: expected %s for %q but got %s", test.expected.Leaf.Subject, test.serverName, cert.Leaf.Subject)
+		}
+	}
+}
+
+func TestTemporaryTLSConfigReload(t *testing.T) {
+	_, certs, err := newTemporaryTLSConfig("reload.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managed, err := newTemporaryCertificate("reload.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.swap(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil }, managed)
+
+	// a reloaded server serves the certificate swapped in on first startup
+	tlsConfig, reloaded, err := newTemporaryTLSConfig("reload.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded != certs {
+		t.Errorf("Error: expected the reloaded server to keep the certificate switch")
+	}
+	if !(AcmeHandler{certReady: reloaded.ready}).Ready() {
+		t.Errorf("Error: expected a reloaded server to be ready")
+	}
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "reload.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf != managed.Leaf {
+		t.Errorf("Error: expected the managed certificate after a reload but got %s", cert.Leaf.Subject)
+	}
+	if got := testutil.ToFloat64(temporaryCertificate.WithLabelValues("reload.example.com")); got != 0 {
+		t.Errorf("Error: expected the temporary certificate gauge to be 0 after a reload but got %v", got)
+	}
+}
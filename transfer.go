@@ -0,0 +1,291 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// transferEnvelope is the number of records sent in each message of a
+	// transfer.
+	transferEnvelope = 500
+	// tsigFudge is the clock skew allowed for signed messages, in seconds.
+	tsigFudge = 300
+)
+
+// errUnknownTSIGKey is returned when a request is signed with a key that is
+// not configured.
+var errUnknownTSIGKey = errors.New("unknown TSIG key")
+
+// notifyPort is the port secondaries are sent NOTIFY messages on.
+var notifyPort = "53"
+
+// tsigAlgorithms maps the names accepted by the transfer directive to TSIG
+// algorithms.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// TransferConfig holds the secondaries allowed to transfer the zone with
+// AXFR and IXFR, set by the transfer directive.
+type TransferConfig struct {
+	// To are the networks of the secondaries. Single hosts among them are
+	// sent NOTIFY messages when the challenge records change, so that they
+	// do not wait for the SOA refresh to pick them up.
+	To []*net.IPNet
+	// Keys are the TSIG keys transfers must be signed with, if any.
+	Keys []TSIGKey
+}
+
+// TSIGKey is a TSIG key, with its name and algorithm fully qualified and its
+// secret base64 encoded.
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+// allowed reports whether ip may transfer the zone.
+func (t *TransferConfig) allowed(ip net.IP) bool {
+	for _, network := range t.To {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the TSIG of a transfer request, returning the key it was
+// signed with, or nil when no keys are configured. CoreDNS does not give
+// its servers the TSIG secrets, so the request is packed again to verify
+// it, with and without name compression as its original form is not known.
+func (t *TransferConfig) verify(r *dns.Msg) (*TSIGKey, error) {
+	if len(t.Keys) == 0 {
+		return nil, nil
+	}
+	tsig := r.IsTsig()
+	if tsig == nil {
+		return nil, errors.New("the request is not signed")
+	}
+	for i, key := range t.Keys {
+		if !strings.EqualFold(key.Name, tsig.Hdr.Name) || !strings.EqualFold(key.Algorithm, tsig.Algorithm) {
+			continue
+		}
+		var err error
+		for _, compress := range []bool{false, true} {
+			m := r.Copy()
+			m.Compress = compress
+			buf, packErr := m.Pack()
+			if packErr != nil {
+				return nil, packErr
+			}
+			if err = dns.TsigVerify(buf, key.Secret, "", false); err == nil {
+				return &t.Keys[i], nil
+			}
+		}
+		return nil, fmt.Errorf("TSIG key %s: %w", key.Name, err)
+	}
+	return nil, fmt.Errorf("%w %s with algorithm %s", errUnknownTSIGKey, tsig.Hdr.Name, tsig.Algorithm)
+}
+
+// tsigErrorCode returns the TSIG error reporting a failed verification
+// (RFC 8945 section 5.2).
+func tsigErrorCode(err error) uint16 {
+	switch {
+	case errors.Is(err, dns.ErrTime):
+		return dns.RcodeBadTime
+	case errors.Is(err, errUnknownTSIGKey):
+		return dns.RcodeBadKey
+	}
+	return dns.RcodeBadSig
+}
+
+// notify sends NOTIFY messages for the new serial of zone to the single
+// hosts of To (RFC 1996), signed with the first key if any.
+func (t *TransferConfig) notify(zone string, serial uint32) {
+	for _, network := range t.To {
+		if ones, bits := network.Mask.Size(); ones != bits {
+			continue
+		}
+		m := new(dns.Msg)
+		m.SetNotify(zone)
+		c := new(dns.Client)
+		if len(t.Keys) > 0 {
+			key := t.Keys[0]
+			c.TsigSecret = map[string]string{key.Name: key.Secret}
+			m.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+		}
+		target := net.JoinHostPort(network.IP.String(), notifyPort)
+		if _, _, err := c.Exchange(m, target); err != nil {
+			log.Warningf("Notifying %s of serial %d of %s: %v", target, serial, zone, err)
+		}
+	}
+}
+
+// transfer answers AXFR and IXFR queries for the zone from the secondaries
+// allowed by the transfer directive. Transfers carry the unsigned records,
+// which is why the directive cannot be combined with dnssec.
+func (h AcmeHandler) transfer(ctx context.Context, state request.Request, zone string) (int, error) {
+	if h.Transfer == nil || strings.ToLower(state.Name()) != zone || !h.Transfer.allowed(net.ParseIP(state.IP())) {
+		return dns.RcodeRefused, nil
+	}
+	key, err := h.Transfer.verify(state.Req)
+	if err != nil {
+		log.Warningf("Refusing the transfer of %s to %s: %v", zone, state.IP(), err)
+		m := new(dns.Msg)
+		m.SetRcode(state.Req, dns.RcodeNotAuth)
+		if tsig := state.Req.IsTsig(); tsig != nil {
+			// the error goes in an unsigned TSIG (RFC 8945 section 5.3.2)
+			m.Extra = append(m.Extra, &dns.TSIG{
+				Hdr:        dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+				Algorithm:  tsig.Algorithm,
+				TimeSigned: uint64(time.Now().Unix()),
+				Fudge:      tsigFudge,
+				OrigId:     state.Req.Id,
+				Error:      tsigErrorCode(err),
+			})
+		}
+		if err := state.W.WriteMsg(m); err != nil {
+			log.Error("acmeHandler.transfer write error: ", err)
+			return dns.RcodeServerFailure, err
+		}
+		return dns.RcodeNotAuth, nil
+	}
+	udp := state.Proto() == "udp"
+	if state.QType() == dns.TypeAXFR && udp {
+		return dns.RcodeRefused, nil
+	}
+	class := state.QClass()
+	serial, records, history := h.provider.snapshot()
+	var rrs []dns.RR
+	if state.QType() == dns.TypeIXFR {
+		rrs = h.ixfr(ctx, zone, class, state.Req, serial, history, udp)
+	}
+	if rrs == nil {
+		rrs = h.axfr(ctx, zone, class, serial, records)
+	}
+
+	var mac string
+	if key != nil {
+		mac = state.Req.IsTsig().MAC
+	}
+	for i := 0; i < len(rrs); i += transferEnvelope {
+		m := new(dns.Msg)
+		m.SetReply(state.Req)
+		m.Authoritative = true
+		end := i + transferEnvelope
+		if end > len(rrs) {
+			end = len(rrs)
+		}
+		m.Answer = rrs[i:end]
+		if key == nil {
+			err = state.W.WriteMsg(m)
+		} else {
+			// the messages after the first are signed with the MAC of the
+			// previous one and the timers only (RFC 8945 section 5.3.1)
+			m.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+			var buf []byte
+			buf, mac, err = dns.TsigGenerate(m, key.Secret, mac, i > 0)
+			if err == nil {
+				_, err = state.W.Write(buf)
+			}
+		}
+		if err != nil {
+			log.Error("acmeHandler.transfer write error: ", err)
+			return dns.RcodeServerFailure, err
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// axfr returns the whole zone: the records of the apex, the addresses of
+// the nameservers in the zone and the TXT records of the challenge names,
+// between SOA records. The challenge names are apexes only to DNS-01
+// solvers, so their SOA and NS records are left out.
+func (h AcmeHandler) axfr(ctx context.Context, zone string, class uint16, serial uint32, records []challengeRecord) []dns.RR {
+	soa := h.transferSOA(ctx, zone, class, serial)
+	rrs := []dns.RR{soa}
+	ttl := orDefault(h.TTL.Apex, defaultApexTTL)
+	for _, qtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeAAAA, dns.TypeCAA} {
+		a := new(dns.Msg)
+		h.answer(ctx, zone, zone, zone, qtype, class, a)
+		for _, rr := range append(a.Answer, a.Extra...) {
+			rr.Header().Ttl = ttl
+			rrs = append(rrs, rr)
+		}
+	}
+	var inZone []challengeRecord
+	for _, record := range records {
+		if dns.IsSubDomain(zone, record.Zone) {
+			inZone = append(inZone, record)
+		}
+	}
+	rrs = append(rrs, h.challengeTXT(inZone, class)...)
+	return append(rrs, soa)
+}
+
+// ixfr returns the changes since the serial of the SOA in the authority
+// section of r (RFC 1995), or nil when they are no longer all known. Over
+// UDP only the SOA is returned, which tells the secondary to retry over TCP
+// when it is behind.
+func (h AcmeHandler) ixfr(ctx context.Context, zone string, class uint16, r *dns.Msg, serial uint32, history []zoneChange, udp bool) []dns.RR {
+	var client *dns.SOA
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			client = soa
+		}
+	}
+	if client == nil {
+		return nil
+	}
+	soa := h.transferSOA(ctx, zone, class, serial)
+	if int32(client.Serial-serial) >= 0 || udp {
+		return []dns.RR{soa}
+	}
+	for i, change := range history {
+		if change.From != client.Serial {
+			continue
+		}
+		rrs := []dns.RR{soa}
+		for _, change := range history[i:] {
+			rrs = append(rrs, h.transferSOA(ctx, zone, class, change.From))
+			rrs = append(rrs, h.challengeTXT(change.Deleted, class)...)
+			rrs = append(rrs, h.transferSOA(ctx, zone, class, change.To))
+			rrs = append(rrs, h.challengeTXT(change.Added, class)...)
+		}
+		return append(rrs, soa)
+	}
+	return nil
+}
+
+func (h AcmeHandler) transferSOA(ctx context.Context, zone string, class uint16, serial uint32) dns.RR {
+	a := new(dns.Msg)
+	h.handleSOA(ctx, zone, class, a)
+	soa := a.Answer[0].(*dns.SOA)
+	soa.Serial = serial
+	soa.Hdr.Ttl = orDefault(h.TTL.Apex, defaultApexTTL)
+	return soa
+}
+
+func (h AcmeHandler) challengeTXT(records []challengeRecord, class uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr := new(dns.TXT)
+		rr.Txt = []string{record.Value}
+		rr.Hdr = dns.RR_Header{Name: record.Zone, Rrtype: dns.TypeTXT, Class: class, Ttl: orDefault(h.TTL.Challenge, defaultChallengeTTL)}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
@@ -0,0 +1,233 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const testTSIGSecret = "c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1zZWNvbmRhcnk="
+
+func newTransferHandler(t *testing.T, keys []TSIGKey) (AcmeHandler, *Provider) {
+	_, network, err := net.ParseCIDR("10.240.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &Provider{recordMap: make(map[string]*RecordStore)}
+	return AcmeHandler{
+		Next:     plugintest.NextHandler(dns.RcodeRefused, nil),
+		provider: provider,
+		AcmeConfig: &AcmeConfig{
+			Zone:                    "test.domain",
+			Ipv4Addrs:               []net.IP{net.ParseIP("203.0.113.5").To4()},
+			AuthoritativeNameserver: "ns1.test.domain.",
+			Nameservers:             []Nameserver{{Name: "ns1.test.domain.", Addresses: []net.IP{net.ParseIP("203.0.113.1")}}},
+			Transfer:                &TransferConfig{To: []*net.IPNet{network}, Keys: keys},
+		},
+	}, provider
+}
+
+func TestServeDNSTransfer(t *testing.T) {
+	h, provider := newTransferHandler(t, nil)
+	ctx := context.Background()
+	first, second := "_acme-challenge.test.domain.", "_acme-challenge.www.test.domain."
+	start := provider.Serial()
+	if _, err := provider.AppendRecords(ctx, first, []libdns.Record{{Type: "TXT", Name: first, Value: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.AppendRecords(ctx, second, []libdns.Record{{Type: "TXT", Name: second, Value: "second"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.DeleteRecords(ctx, first, []libdns.Record{{Type: "TXT", Name: first, Value: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	current := provider.Serial()
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		serial  uint32
+		tcp     bool
+		remote  string
+		rcode   int
+		answers int
+		txt     int
+	}{
+		// SOA, NS, glue, A, TXT, SOA
+		{"AXFR", "test.domain.", dns.TypeAXFR, 0, true, "", dns.RcodeSuccess, 6, 1},
+		{"AXFR over UDP", "test.domain.", dns.TypeAXFR, 0, false, "", dns.RcodeRefused, 0, 0},
+		{"AXFR from another address", "test.domain.", dns.TypeAXFR, 0, true, "192.0.2.1", dns.RcodeRefused, 0, 0},
+		{"AXFR of a challenge name", first, dns.TypeAXFR, 0, true, "", dns.RcodeRefused, 0, 0},
+		// SOA, the SOA before and after each of the three changes with
+		// the TXT record deleted or added, then SOA
+		{"IXFR from the start", "test.domain.", dns.TypeIXFR, start, true, "", dns.RcodeSuccess, 11, 3},
+		{"IXFR up to date", "test.domain.", dns.TypeIXFR, current, true, "", dns.RcodeSuccess, 1, 0},
+		{"IXFR over UDP", "test.domain.", dns.TypeIXFR, start, false, "", dns.RcodeSuccess, 1, 0},
+		{"IXFR from an unknown serial", "test.domain.", dns.TypeIXFR, start - 10, true, "", dns.RcodeSuccess, 6, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			if test.qtype == dns.TypeIXFR {
+				req.SetIxfr(test.qname, test.serial, "ns1.test.domain.", "hostmaster.test.domain.")
+			} else {
+				req.SetAxfr(test.qname)
+			}
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{TCP: test.tcp, RemoteIP: test.remote})
+			rcode, err := h.ServeDNS(ctx, rec, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Msg == nil {
+				if rcode != test.rcode {
+					t.Fatalf("Error: expected rcode %d but got %d", test.rcode, rcode)
+				}
+				return
+			}
+			resp := rec.Msg
+			txt := 0
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype == dns.TypeTXT {
+					txt++
+				}
+			}
+			if resp.Rcode != test.rcode || len(resp.Answer) != test.answers || txt != test.txt {
+				t.Fatalf("Error: expected rcode %d with %d records of which %d TXT but got %v", test.rcode, test.answers, test.txt, resp)
+			}
+			for _, rr := range []dns.RR{resp.Answer[0], resp.Answer[len(resp.Answer)-1]} {
+				if soa, ok := rr.(*dns.SOA); !ok || soa.Serial != current {
+					t.Errorf("Error: expected the transfer to start and end with the SOA of serial %d but got %v", current, rr)
+				}
+			}
+		})
+	}
+}
+
+// tsigRecorder records the messages written by the handler as they are
+// sent, with their TSIG.
+type tsigRecorder struct {
+	plugintest.ResponseWriter
+	msgs [][]byte
+}
+
+func (r *tsigRecorder) Write(buf []byte) (int, error) {
+	r.msgs = append(r.msgs, buf)
+	return len(buf), nil
+}
+
+func TestServeDNSTransferTSIG(t *testing.T) {
+	key := TSIGKey{Name: "transfer.key.", Algorithm: dns.HmacSHA256, Secret: testTSIGSecret}
+	h, _ := newTransferHandler(t, []TSIGKey{key})
+	tests := []struct {
+		name    string
+		key     *TSIGKey
+		rcode   int
+		signed  bool
+		tsigErr uint16
+	}{
+		{"Signed", &key, dns.RcodeSuccess, true, dns.RcodeSuccess},
+		{"Unsigned", nil, dns.RcodeNotAuth, false, dns.RcodeSuccess},
+		{"Wrong secret", &TSIGKey{Name: key.Name, Algorithm: key.Algorithm, Secret: "d3Jvbmc="}, dns.RcodeNotAuth, false, dns.RcodeBadSig},
+		{"Unknown key", &TSIGKey{Name: "other.key.", Algorithm: key.Algorithm, Secret: key.Secret}, dns.RcodeNotAuth, false, dns.RcodeBadKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetAxfr("test.domain.")
+			var mac string
+			if test.key != nil {
+				req.SetTsig(test.key.Name, test.key.Algorithm, tsigFudge, time.Now().Unix())
+				buf, requestMAC, err := dns.TsigGenerate(req, test.key.Secret, "", false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				mac = requestMAC
+				// the server hands the plugin the unpacked request
+				req = new(dns.Msg)
+				if err := req.Unpack(buf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w := &tsigRecorder{ResponseWriter: plugintest.ResponseWriter{TCP: true}}
+			rec := dnstest.NewRecorder(w)
+			rcode, err := h.ServeDNS(context.Background(), rec, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rcode != test.rcode || (len(w.msgs) > 0) != test.signed {
+				t.Fatalf("Error: expected rcode %d and signed %v but got %d and %d messages", test.rcode, test.signed, rcode, len(w.msgs))
+			}
+			for _, buf := range w.msgs {
+				if err := dns.TsigVerify(buf, key.Secret, mac, false); err != nil {
+					t.Errorf("Error: expected the response to be signed but got %v", err)
+				}
+			}
+			if test.signed {
+				return
+			}
+			// the refusal is written by the handler, with the TSIG error
+			// in an unsigned TSIG when the request had one
+			if rec.Msg == nil || rec.Msg.Rcode != test.rcode {
+				t.Fatalf("Error: expected a reply with rcode %d but got %v", test.rcode, rec.Msg)
+			}
+			tsig := rec.Msg.IsTsig()
+			if (tsig != nil) != (test.key != nil) {
+				t.Fatalf("Error: expected a TSIG %v but got %v", test.key != nil, tsig)
+			}
+			if tsig != nil && (tsig.Error != test.tsigErr || tsig.MACSize != 0) {
+				t.Errorf("Error: expected TSIG error %d without a MAC but got %d with a MAC of %d", test.tsigErr, tsig.Error, tsig.MACSize)
+			}
+		})
+	}
+}
+
+func TestTransferNotify(t *testing.T) {
+	key := TSIGKey{Name: "transfer.key.", Algorithm: dns.HmacSHA256, Secret: testTSIGSecret}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan *dns.Msg, 1)
+	server := &dns.Server{
+		PacketConn: pc,
+		TsigSecret: map[string]string{key.Name: key.Secret},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if w.TsigStatus() != nil {
+				t.Errorf("Error: expected a signed NOTIFY but got %v", w.TsigStatus())
+			}
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+			w.WriteMsg(m)
+			notified <- r
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	defaultPort := notifyPort
+	notifyPort = port
+	defer func() { notifyPort = defaultPort }()
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	transfer := &TransferConfig{
+		To:   []*net.IPNet{network, {IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(32, 32)}},
+		Keys: []TSIGKey{key},
+	}
+	transfer.notify("test.domain.", 1)
+	select {
+	case r := <-notified:
+		if r.Opcode != dns.OpcodeNotify || r.Question[0].Name != "test.domain." || r.Question[0].Qtype != dns.TypeSOA {
+			t.Errorf("Error: expected a NOTIFY for test.domain. but got %v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error: expected the secondary to be notified")
+	}
+}